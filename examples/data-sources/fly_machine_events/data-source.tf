@@ -0,0 +1,4 @@
+data "fly_machine_events" "example" {
+  app = "hellofromterraform"
+  id  = fly_machine.exampleMachine.id
+}
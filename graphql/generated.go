@@ -1337,6 +1337,66 @@ type VolumeQueryResponse struct {
 // GetApp returns VolumeQueryResponse.App, and is useful for accessing the field via an interface.
 func (v *VolumeQueryResponse) GetApp() VolumeQueryApp { return v.App }
 
+// WireguardPeersOrganization includes the requested fields of the GraphQL type Organization.
+type WireguardPeersOrganization struct {
+	WireGuardPeers WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnection `json:"wireGuardPeers"`
+}
+
+// GetWireGuardPeers returns WireguardPeersOrganization.WireGuardPeers, and is useful for accessing the field via an interface.
+func (v *WireguardPeersOrganization) GetWireGuardPeers() WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnection {
+	return v.WireGuardPeers
+}
+
+// WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnection includes the requested fields of the GraphQL type WireGuardPeerConnection.
+type WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnection struct {
+	Nodes    []WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionNodesWireGuardPeer `json:"nodes"`
+	PageInfo WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionPageInfo             `json:"pageInfo"`
+}
+
+// GetNodes returns WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnection.Nodes, and is useful for accessing the field via an interface.
+func (v *WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnection) GetNodes() []WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionNodesWireGuardPeer {
+	return v.Nodes
+}
+
+// GetPageInfo returns WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnection.PageInfo, and is useful for accessing the field via an interface.
+func (v *WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnection) GetPageInfo() WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionPageInfo {
+	return v.PageInfo
+}
+
+// WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionNodesWireGuardPeer includes the requested fields of the GraphQL type WireGuardPeer.
+type WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionNodesWireGuardPeer struct {
+	Name string `json:"name"`
+}
+
+// GetName returns WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionNodesWireGuardPeer.Name, and is useful for accessing the field via an interface.
+func (v *WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionNodesWireGuardPeer) GetName() string {
+	return v.Name
+}
+
+// WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionPageInfo includes the requested fields of the GraphQL type PageInfo.
+type WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionPageInfo struct {
+	HasNextPage bool   `json:"hasNextPage"`
+	EndCursor   string `json:"endCursor"`
+}
+
+// GetHasNextPage returns WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionPageInfo.HasNextPage, and is useful for accessing the field via an interface.
+func (v *WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionPageInfo) GetHasNextPage() bool {
+	return v.HasNextPage
+}
+
+// GetEndCursor returns WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionPageInfo.EndCursor, and is useful for accessing the field via an interface.
+func (v *WireguardPeersOrganizationWireGuardPeersWireGuardPeerConnectionPageInfo) GetEndCursor() string {
+	return v.EndCursor
+}
+
+// WireguardPeersResponse is returned by WireguardPeers on success.
+type WireguardPeersResponse struct {
+	Organization WireguardPeersOrganization `json:"organization"`
+}
+
+// GetOrganization returns WireguardPeersResponse.Organization, and is useful for accessing the field via an interface.
+func (v *WireguardPeersResponse) GetOrganization() WireguardPeersOrganization { return v.Organization }
+
 // __AddCertificateInput is used internally by genqlient
 type __AddCertificateInput struct {
 	App      string `json:"app"`
@@ -1599,6 +1659,18 @@ func (v *__VolumeQueryInput) GetApp() string { return v.App }
 // GetInternal returns __VolumeQueryInput.Internal, and is useful for accessing the field via an interface.
 func (v *__VolumeQueryInput) GetInternal() string { return v.Internal }
 
+// __WireguardPeersInput is used internally by genqlient
+type __WireguardPeersInput struct {
+	Org   string `json:"org"`
+	After string `json:"after,omitempty"`
+}
+
+// GetOrg returns __WireguardPeersInput.Org, and is useful for accessing the field via an interface.
+func (v *__WireguardPeersInput) GetOrg() string { return v.Org }
+
+// GetAfter returns __WireguardPeersInput.After, and is useful for accessing the field via an interface.
+func (v *__WireguardPeersInput) GetAfter() string { return v.After }
+
 func AddCertificate(
 	ctx context.Context,
 	client graphql.Client,
@@ -2495,3 +2567,45 @@ query VolumeQuery ($app: String, $internal: String!) {
 
 	return &data, err
 }
+
+func WireguardPeers(
+	ctx context.Context,
+	client graphql.Client,
+	org string,
+	after string,
+) (*WireguardPeersResponse, error) {
+	req := &graphql.Request{
+		OpName: "WireguardPeers",
+		Query: `
+query WireguardPeers ($org: ID!, $after: String) {
+	organization(id: $org) {
+		wireGuardPeers(first: 100, after: $after) {
+			nodes {
+				name
+			}
+			pageInfo {
+				hasNextPage
+				endCursor
+			}
+		}
+	}
+}
+`,
+		Variables: &__WireguardPeersInput{
+			Org:   org,
+			After: after,
+		},
+	}
+	var err error
+
+	var data WireguardPeersResponse
+	resp := &graphql.Response{Data: &data}
+
+	err = client.MakeRequest(
+		ctx,
+		req,
+		resp,
+	)
+
+	return &data, err
+}
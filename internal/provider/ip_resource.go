@@ -6,11 +6,9 @@ import (
 	"fmt"
 
 	"github.com/fly-apps/terraform-provider-fly/graphql"
-	"github.com/fly-apps/terraform-provider-fly/internal/provider/modifiers"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
-	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
 	"github.com/vektah/gqlparser/v2/gqlerror"
@@ -64,9 +62,6 @@ func (flyIpResource) Schema(_ context.Context, _ resource.SchemaRequest, rep *re
 			"region": schema.StringAttribute{
 				MarkdownDescription: "region",
 				Computed:            true,
-				PlanModifiers: []planmodifier.String{
-					modifiers.StringDefault("global"),
-				},
 			},
 		},
 	}
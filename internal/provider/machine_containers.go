@@ -0,0 +1,231 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/fly-apps/terraform-provider-fly/internal/utils"
+	"github.com/fly-apps/terraform-provider-fly/pkg/apiv1"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+var containerDependencyConditions = []string{"started", "healthy", "exited_successfully"}
+
+type TfMachineContainer struct {
+	Name         types.String             `tfsdk:"name"`
+	Image        types.String             `tfsdk:"image"`
+	Cmd          []string                 `tfsdk:"cmd"`
+	Entrypoint   []string                 `tfsdk:"entrypoint"`
+	Env          types.Map                `tfsdk:"env"`
+	Files        []TfContainerFile        `tfsdk:"files"`
+	Healthchecks []TfContainerHealthcheck `tfsdk:"healthchecks"`
+	DependsOn    []TfContainerDependency  `tfsdk:"depends_on"`
+}
+
+type TfContainerFile struct {
+	GuestPath  types.String `tfsdk:"guest_path"`
+	RawValue   types.String `tfsdk:"raw_value"`
+	SecretName types.String `tfsdk:"secret_name"`
+}
+
+type TfContainerHealthcheck struct {
+	Name             types.String          `tfsdk:"name"`
+	Exec             []string              `tfsdk:"exec"`
+	Http             *TfContainerHttpCheck `tfsdk:"http"`
+	Tcp              *TfContainerTcpCheck  `tfsdk:"tcp"`
+	Interval         types.Int64           `tfsdk:"interval"`
+	Timeout          types.Int64           `tfsdk:"timeout"`
+	FailureThreshold types.Int64           `tfsdk:"failure_threshold"`
+}
+
+type TfContainerHttpCheck struct {
+	Port types.Int64  `tfsdk:"port"`
+	Path types.String `tfsdk:"path"`
+}
+
+type TfContainerTcpCheck struct {
+	Port types.Int64 `tfsdk:"port"`
+}
+
+type TfContainerDependency struct {
+	Name      types.String `tfsdk:"name"`
+	Condition types.String `tfsdk:"condition"`
+}
+
+func TfContainersToContainers(input []TfMachineContainer) []apiv1.ContainerConfig {
+	var containers []apiv1.ContainerConfig
+	for _, c := range input {
+		container := apiv1.ContainerConfig{
+			Name:       c.Name.ValueString(),
+			Image:      c.Image.ValueString(),
+			Cmd:        c.Cmd,
+			Entrypoint: c.Entrypoint,
+		}
+		if !c.Env.IsNull() && !c.Env.IsUnknown() {
+			c.Env.ElementsAs(context.Background(), &container.Env, false)
+		}
+		for _, f := range c.Files {
+			file := apiv1.ContainerFile{
+				GuestPath:  f.GuestPath.ValueString(),
+				SecretName: f.SecretName.ValueString(),
+			}
+			if !f.RawValue.IsNull() {
+				file.RawValue = base64.StdEncoding.EncodeToString([]byte(f.RawValue.ValueString()))
+			}
+			container.Files = append(container.Files, file)
+		}
+		for _, h := range c.Healthchecks {
+			check := apiv1.ContainerHealthcheck{
+				Name:             h.Name.ValueString(),
+				Interval:         int(h.Interval.ValueInt64()),
+				Timeout:          int(h.Timeout.ValueInt64()),
+				FailureThreshold: int(h.FailureThreshold.ValueInt64()),
+			}
+			if len(h.Exec) > 0 {
+				check.Exec = &apiv1.ContainerExecHealthcheck{Command: h.Exec}
+			}
+			if h.Http != nil {
+				check.HTTP = &apiv1.ContainerHTTPHealthcheck{Port: int(h.Http.Port.ValueInt64()), Path: h.Http.Path.ValueString()}
+			}
+			if h.Tcp != nil {
+				check.TCP = &apiv1.ContainerTCPHealthcheck{Port: int(h.Tcp.Port.ValueInt64())}
+			}
+			container.Healthchecks = append(container.Healthchecks, check)
+		}
+		for _, d := range c.DependsOn {
+			container.DependsOn = append(container.DependsOn, apiv1.ContainerDependency{
+				Name:      d.Name.ValueString(),
+				Condition: d.Condition.ValueString(),
+			})
+		}
+		containers = append(containers, container)
+	}
+	return containers
+}
+
+func ContainersToTfContainers(input []apiv1.ContainerConfig) []TfMachineContainer {
+	var tfcontainers []TfMachineContainer
+	for _, c := range input {
+		container := TfMachineContainer{
+			Name:       types.StringValue(c.Name),
+			Image:      types.StringValue(c.Image),
+			Cmd:        c.Cmd,
+			Entrypoint: c.Entrypoint,
+			Env:        types.MapNull(types.StringType),
+		}
+		if len(c.Env) > 0 {
+			container.Env = utils.KVToTfMap(c.Env, types.StringType)
+		}
+		for _, f := range c.Files {
+			file := TfContainerFile{
+				GuestPath:  types.StringValue(f.GuestPath),
+				RawValue:   types.StringNull(),
+				SecretName: optionalString(f.SecretName),
+			}
+			if f.RawValue != "" {
+				raw, err := base64.StdEncoding.DecodeString(f.RawValue)
+				if err != nil {
+					raw = []byte(f.RawValue)
+				}
+				file.RawValue = types.StringValue(string(raw))
+			}
+			container.Files = append(container.Files, file)
+		}
+		for _, h := range c.Healthchecks {
+			check := TfContainerHealthcheck{
+				Name:             optionalString(h.Name),
+				Interval:         optionalInt64(h.Interval),
+				Timeout:          optionalInt64(h.Timeout),
+				FailureThreshold: optionalInt64(h.FailureThreshold),
+			}
+			if h.Exec != nil {
+				check.Exec = h.Exec.Command
+			}
+			if h.HTTP != nil {
+				check.Http = &TfContainerHttpCheck{Port: types.Int64Value(int64(h.HTTP.Port)), Path: optionalString(h.HTTP.Path)}
+			}
+			if h.TCP != nil {
+				check.Tcp = &TfContainerTcpCheck{Port: types.Int64Value(int64(h.TCP.Port))}
+			}
+			container.Healthchecks = append(container.Healthchecks, check)
+		}
+		for _, d := range c.DependsOn {
+			container.DependsOn = append(container.DependsOn, TfContainerDependency{
+				Name:      types.StringValue(d.Name),
+				Condition: optionalString(d.Condition),
+			})
+		}
+		tfcontainers = append(tfcontainers, container)
+	}
+	return tfcontainers
+}
+
+func optionalInt64(v int) types.Int64 {
+	if v == 0 {
+		return types.Int64Null()
+	}
+	return types.Int64Value(int64(v))
+}
+
+// validateContainers checks that a machine runs either the top-level image or containers, and that the containers
+// refer to each other correctly.
+func validateContainers(image types.String, containers []TfMachineContainer, diags *diag.Diagnostics) {
+	if image.IsUnknown() {
+		return
+	}
+	if len(containers) == 0 {
+		if image.IsNull() {
+			diags.AddAttributeError(path.Root("image"), "Missing image", "One of image or containers must be set")
+		}
+		return
+	}
+	if !image.IsNull() {
+		diags.AddAttributeError(path.Root("image"), "Conflicting image", "image can't be combined with containers, set the image of each container instead")
+	}
+
+	names := map[string]bool{}
+	for i, c := range containers {
+		if c.Name.IsUnknown() {
+			continue
+		}
+		if names[c.Name.ValueString()] {
+			diags.AddAttributeError(path.Root("containers").AtListIndex(i).AtName("name"), "Duplicate container name", fmt.Sprintf("%s is used by more than one container", c.Name.ValueString()))
+		}
+		names[c.Name.ValueString()] = true
+	}
+
+	for i, c := range containers {
+		for j, h := range c.Healthchecks {
+			kinds := 0
+			if len(h.Exec) > 0 {
+				kinds++
+			}
+			if h.Http != nil {
+				kinds++
+			}
+			if h.Tcp != nil {
+				kinds++
+			}
+			if kinds != 1 {
+				diags.AddAttributeError(path.Root("containers").AtListIndex(i).AtName("healthchecks").AtListIndex(j), "Invalid healthcheck", "Exactly one of exec, http or tcp must be set")
+			}
+		}
+		for j, d := range c.DependsOn {
+			p := path.Root("containers").AtListIndex(i).AtName("depends_on").AtListIndex(j)
+			if !d.Name.IsUnknown() && !c.Name.IsUnknown() {
+				if d.Name.Equal(c.Name) {
+					diags.AddAttributeError(p.AtName("name"), "Invalid container dependency", fmt.Sprintf("%s can't depend on itself", c.Name.ValueString()))
+				} else if !names[d.Name.ValueString()] {
+					diags.AddAttributeError(p.AtName("name"), "Invalid container dependency", fmt.Sprintf("There is no container named %s", d.Name.ValueString()))
+				}
+			}
+			if !d.Condition.IsNull() && !d.Condition.IsUnknown() && !contains(containerDependencyConditions, d.Condition.ValueString()) {
+				diags.AddAttributeError(p.AtName("condition"), "Invalid container dependency", fmt.Sprintf("condition must be one of %s, got %q", strings.Join(containerDependencyConditions, ", "), d.Condition.ValueString()))
+			}
+		}
+	}
+}
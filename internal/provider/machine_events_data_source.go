@@ -0,0 +1,132 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/fly-apps/terraform-provider-fly/pkg/apiv1"
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+var _ datasource.DataSourceWithConfigure = &machineEventsDataSource{}
+
+// Matches getSchema
+type machineEventsDataSourceOutput struct {
+	Id     types.String         `tfsdk:"id"`
+	App    types.String         `tfsdk:"app"`
+	Events []machineEventOutput `tfsdk:"events"`
+}
+
+type machineEventOutput struct {
+	Type      types.String `tfsdk:"type"`
+	Status    types.String `tfsdk:"status"`
+	Source    types.String `tfsdk:"source"`
+	Timestamp types.String `tfsdk:"timestamp"`
+	ExitCode  types.Int64  `tfsdk:"exit_code"`
+}
+
+func (d machineEventsDataSource) Metadata(_ context.Context, _ datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = "fly_machine_events"
+}
+
+func (d machineEventsDataSource) Schema(_ context.Context, _ datasource.SchemaRequest, rep *datasource.SchemaResponse) {
+	rep.Schema = schema.Schema{
+		MarkdownDescription: "Fly machine events data source",
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				MarkdownDescription: "machine id",
+				Required:            true,
+			},
+			"app": schema.StringAttribute{
+				MarkdownDescription: "fly app",
+				Required:            true,
+			},
+			"events": schema.ListNestedAttribute{
+				MarkdownDescription: "Machine events as returned by the machines api",
+				Computed:            true,
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"type": schema.StringAttribute{
+							MarkdownDescription: "Event type, e.g. `launch`, `start` or `exit`",
+							Computed:            true,
+						},
+						"status": schema.StringAttribute{
+							MarkdownDescription: "Machine status recorded by the event",
+							Computed:            true,
+						},
+						"source": schema.StringAttribute{
+							MarkdownDescription: "Component that emitted the event",
+							Computed:            true,
+						},
+						"timestamp": schema.StringAttribute{
+							MarkdownDescription: "RFC3339 time the event was recorded",
+							Computed:            true,
+						},
+						"exit_code": schema.Int64Attribute{
+							MarkdownDescription: "Exit code of the machine, only set for exit events",
+							Computed:            true,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newMachineEventsDataSource() datasource.DataSource {
+	return &machineEventsDataSource{}
+}
+
+func (d machineEventsDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	_, err := d.ValidateOpenTunnel()
+	if err != nil {
+		resp.Diagnostics.AddError("fly wireguard tunnel must be open", err.Error())
+		return
+	}
+
+	var data machineEventsDataSourceOutput
+
+	diags := req.Config.Get(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	machineAPI := apiv1.NewMachineAPI(&d.httpClient, d.httpEndpoint)
+
+	var machine apiv1.MachineResponse
+	readResponse, err := machineAPI.ReadMachine(data.App.ValueString(), data.Id.ValueString(), &machine)
+	if err != nil {
+		resp.Diagnostics.AddError("Failed to read machine", err.Error())
+		return
+	}
+	if readResponse.StatusCode != http.StatusOK {
+		resp.Diagnostics.AddError("Failed to read machine", fmt.Sprintf("Read request failed: %s", readResponse.Status))
+		return
+	}
+
+	events := make([]machineEventOutput, 0, len(machine.Events))
+	for _, e := range machine.Events {
+		event := machineEventOutput{
+			Type:      types.StringValue(e.Type),
+			Status:    types.StringValue(e.Status),
+			Source:    types.StringValue(e.Source),
+			Timestamp: types.StringValue(e.Time().UTC().Format(time.RFC3339)),
+			ExitCode:  types.Int64Null(),
+		}
+		if code, ok := e.ExitCode(); ok {
+			event.ExitCode = types.Int64Value(int64(code))
+		}
+		events = append(events, event)
+	}
+
+	data.Events = events
+
+	diags = resp.State.Set(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+}
@@ -0,0 +1,49 @@
+package provider
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/acctest"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+)
+
+func TestAccFlyMachineEventsDataSource(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineEventsDataSourceConfig(rName),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttrPair("data.fly_machine_events.testEvents", "id", "fly_machine.testMachine", "id"),
+					resource.TestCheckResourceAttrSet("data.fly_machine_events.testEvents", "events.0.type"),
+					resource.TestCheckResourceAttrSet("data.fly_machine_events.testEvents", "events.0.timestamp"),
+				),
+			},
+		},
+	})
+}
+
+func testFlyMachineEventsDataSourceConfig(name string) string {
+	app := os.Getenv("FLY_TF_TEST_APP")
+
+	return fmt.Sprintf(`
+%s
+
+resource "fly_machine" "testMachine" {
+	app = "%s"
+	region = "%s"
+	name = "%s"
+    image = "nginx"
+}
+
+data "fly_machine_events" "testEvents" {
+	app = fly_machine.testMachine.app
+	id = fly_machine.testMachine.id
+}
+`, providerConfig(), app, getTestRegion(), name)
+}
@@ -0,0 +1,102 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// defaultReadinessTimeout is how long readiness probes are retried when the block doesn't set a timeout.
+const defaultReadinessTimeout = 60 * time.Second
+
+type TfMachineReadiness struct {
+	Port           types.Int64  `tfsdk:"port"`
+	Path           types.String `tfsdk:"path"`
+	ExpectedStatus types.Int64  `tfsdk:"expected_status"`
+	Timeout        types.String `tfsdk:"timeout"`
+}
+
+func (r TfMachineReadiness) timeout() (time.Duration, error) {
+	if r.Timeout.IsNull() || r.Timeout.IsUnknown() {
+		return defaultReadinessTimeout, nil
+	}
+	return time.ParseDuration(r.Timeout.ValueString())
+}
+
+// dialContext dials through the internal tunnel when there is one, so the machine's private ip is reachable
+// without wireguard being set up on the host.
+func (c providerClients) dialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if c.tunnel != nil {
+		return c.tunnel.DialContext(ctx, network, address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// waitForReadiness probes the machine at privateIP until it answers as the readiness block expects: a tcp
+// connection, or with a path set, an http response with the expected status.
+func (c providerClients) waitForReadiness(ctx context.Context, privateIP string, readiness TfMachineReadiness) error {
+	timeout, err := readiness.timeout()
+	if err != nil {
+		return err
+	}
+	address := net.JoinHostPort(privateIP, fmt.Sprintf("%d", readiness.Port.ValueInt64()))
+
+	// One client for all probes, each probe is a fresh connection so a machine that restarts isn't missed.
+	client := &http.Client{Transport: &http.Transport{DialContext: c.dialContext, DisableKeepAlives: true}}
+	defer client.CloseIdleConnections()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = c.probe(ctx, client, address, readiness)
+		if err == nil {
+			return nil
+		}
+		tflog.Debug(ctx, fmt.Sprintf("readiness probe of %s failed: %s", address, err))
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s not ready after %s: %w", address, timeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (c providerClients) probe(ctx context.Context, client *http.Client, address string, readiness TfMachineReadiness) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if readiness.Path.IsNull() {
+		conn, err := c.dialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s%s", address, readiness.Path.ValueString()), nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	expected := int64(http.StatusOK)
+	if !readiness.ExpectedStatus.IsNull() {
+		expected = readiness.ExpectedStatus.ValueInt64()
+	}
+	if int64(res.StatusCode) != expected {
+		return fmt.Errorf("got status %d, expected %d", res.StatusCode, expected)
+	}
+	return nil
+}
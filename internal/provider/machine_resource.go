@@ -2,14 +2,21 @@ package provider
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
+	"github.com/fly-apps/terraform-provider-fly/internal/provider/modifiers"
 	"github.com/fly-apps/terraform-provider-fly/internal/utils"
 	"github.com/fly-apps/terraform-provider-fly/pkg/apiv1"
+	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/listplanmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/types"
@@ -17,8 +24,10 @@ import (
 )
 
 var (
-	_ resource.ResourceWithConfigure   = &flyMachineResource{}
-	_ resource.ResourceWithImportState = &flyMachineResource{}
+	_ resource.ResourceWithConfigure      = &flyMachineResource{}
+	_ resource.ResourceWithImportState    = &flyMachineResource{}
+	_ resource.ResourceWithValidateConfig = &flyMachineResource{}
+	_ resource.ResourceWithModifyPlan     = &flyMachineResource{}
 )
 
 type flyMachineResource struct {
@@ -41,22 +50,43 @@ type TfService struct {
 }
 
 type flyMachineResourceData struct {
-	Name       types.String `tfsdk:"name"`
-	Region     types.String `tfsdk:"region"`
-	Id         types.String `tfsdk:"id"`
-	PrivateIP  types.String `tfsdk:"privateip"`
-	App        types.String `tfsdk:"app"`
-	Image      types.String `tfsdk:"image"`
-	Cpus       types.Int64  `tfsdk:"cpus"`
-	MemoryMb   types.Int64  `tfsdk:"memorymb"`
-	CpuType    types.String `tfsdk:"cputype"`
-	Env        types.Map    `tfsdk:"env"`
-	Cmd        []string     `tfsdk:"cmd"`
-	Entrypoint []string     `tfsdk:"entrypoint"`
-	Exec       []string     `tfsdk:"exec"`
-
-	Mounts   []TfMachineMount `tfsdk:"mounts"`
-	Services []TfService      `tfsdk:"services"`
+	Name      types.String `tfsdk:"name"`
+	Region    types.String `tfsdk:"region"`
+	Id        types.String `tfsdk:"id"`
+	PrivateIP types.String `tfsdk:"privateip"`
+	App       types.String `tfsdk:"app"`
+	Image     types.String `tfsdk:"image"`
+	Cpus      types.Int64  `tfsdk:"cpus"`
+	MemoryMb  types.Int64  `tfsdk:"memorymb"`
+	CpuType   types.String `tfsdk:"cputype"`
+	Env       types.Map    `tfsdk:"env"`
+	SecretEnv types.Map    `tfsdk:"secret_env"`
+
+	IgnoreEnvKeys []string      `tfsdk:"ignore_env_keys"`
+	Cmd           []string      `tfsdk:"cmd"`
+	Entrypoint    []string      `tfsdk:"entrypoint"`
+	Exec          []string      `tfsdk:"exec"`
+	Standbys      []string      `tfsdk:"standbys"`
+	Tty           types.Bool    `tfsdk:"tty"`
+	SwapSizeMb    types.Int64   `tfsdk:"swap_size_mb"`
+	KernelArgs    []string      `tfsdk:"kernel_args"`
+	Dns           *TfMachineDns `tfsdk:"dns"`
+
+	RegionFallbacks  []string     `tfsdk:"region_fallbacks"`
+	PlacedRegion     types.String `tfsdk:"placed_region"`
+	HostDedicationId types.String `tfsdk:"host_dedication_id"`
+	PreferZone       types.String `tfsdk:"prefer_zone"`
+	AvoidZone        types.String `tfsdk:"avoid_zone"`
+
+	Readiness *TfMachineReadiness `tfsdk:"readiness"`
+
+	UpdateStrategy types.String `tfsdk:"update_strategy"`
+	AutoRollback   types.Bool   `tfsdk:"auto_rollback"`
+	ForceDestroy   types.Bool   `tfsdk:"force_destroy"`
+
+	Mounts     []TfMachineMount     `tfsdk:"mounts"`
+	Services   []TfService          `tfsdk:"services"`
+	Containers []TfMachineContainer `tfsdk:"containers"`
 }
 
 type TfMachineMount struct {
@@ -64,6 +94,32 @@ type TfMachineMount struct {
 	Path      types.String `tfsdk:"path"`
 	SizeGb    types.Int64  `tfsdk:"size_gb"`
 	Volume    types.String `tfsdk:"volume"`
+	VolumeId  types.String `tfsdk:"volume_id"`
+}
+
+type TfMachineDns struct {
+	SkipRegistration types.Bool `tfsdk:"skip_registration"`
+	Nameservers      []string   `tfsdk:"nameservers"`
+}
+
+// notReplacedOnUpdate holds unless update_strategy is replace, which gives the machine a new id and private ip.
+func notReplacedOnUpdate(ctx context.Context, req planmodifier.StringRequest) (bool, diag.Diagnostics) {
+	var strategy types.String
+	diags := req.Plan.GetAttribute(ctx, path.Root("update_strategy"), &strategy)
+	return !strategy.IsUnknown() && strategy.ValueString() != updateStrategyReplace, diags
+}
+
+// containersUnchanged holds unless containers change, the image the api reports for a machine running containers
+// comes from them.
+func containersUnchanged(ctx context.Context, req planmodifier.StringRequest) (bool, diag.Diagnostics) {
+	var planned, prior types.List
+	diags := req.Plan.GetAttribute(ctx, path.Root("containers"), &planned)
+	diags.Append(req.State.GetAttribute(ctx, path.Root("containers"), &prior)...)
+	return planned.Equal(prior), diags
+}
+
+func mountCountChanged(ctx context.Context, req planmodifier.ListRequest, resp *listplanmodifier.RequiresReplaceIfFuncResponse) {
+	resp.RequiresReplace = req.PlanValue.IsUnknown() || len(req.PlanValue.Elements()) != len(req.StateValue.Elements())
 }
 
 func (mr flyMachineResource) Metadata(_ context.Context, _ resource.MetadataRequest, resp *resource.MetadataResponse) {
@@ -78,24 +134,52 @@ func (flyMachineResource) Schema(_ context.Context, _ resource.SchemaRequest, re
 				MarkdownDescription: "machine name",
 				Optional:            true,
 				Computed:            true,
-				PlanModifiers:       []planmodifier.String{stringplanmodifier.RequiresReplace()},
+				PlanModifiers:       []planmodifier.String{stringplanmodifier.UseStateForUnknown(), stringplanmodifier.RequiresReplace()},
 			},
 			"region": schema.StringAttribute{
 				MarkdownDescription: "machine region",
 				Required:            true,
 				PlanModifiers:       []planmodifier.String{stringplanmodifier.RequiresReplace()},
 			},
+			"region_fallbacks": schema.ListAttribute{
+				MarkdownDescription: "Regions to try, in order, when `region` is out of capacity at creation time",
+				Optional:            true,
+				ElementType:         types.StringType,
+			},
+			"placed_region": schema.StringAttribute{
+				MarkdownDescription: "Region the machine was actually placed in",
+				Computed:            true,
+				PlanModifiers:       []planmodifier.String{stringplanmodifier.UseStateForUnknown()},
+			},
+			"host_dedication_id": schema.StringAttribute{
+				MarkdownDescription: "Only place the machine on hosts dedicated to this id. Changing it replaces the machine",
+				Optional:            true,
+				PlanModifiers:       []planmodifier.String{stringplanmodifier.RequiresReplace()},
+			},
+			"prefer_zone": schema.StringAttribute{
+				MarkdownDescription: "Zone to prefer when placing the machine. Changing it replaces the machine",
+				Optional:            true,
+				PlanModifiers:       []planmodifier.String{stringplanmodifier.RequiresReplace()},
+			},
+			"avoid_zone": schema.StringAttribute{
+				MarkdownDescription: "Zone to avoid when placing the machine. Changing it replaces the machine",
+				Optional:            true,
+				PlanModifiers:       []planmodifier.String{stringplanmodifier.RequiresReplace()},
+			},
 			"id": schema.StringAttribute{
 				MarkdownDescription: "machine id",
 				Computed:            true,
+				PlanModifiers:       []planmodifier.String{modifiers.UseStateForUnknownIf(notReplacedOnUpdate)},
 			},
 			"app": schema.StringAttribute{
 				MarkdownDescription: "fly app",
 				Required:            true,
+				PlanModifiers:       []planmodifier.String{stringplanmodifier.RequiresReplace()},
 			},
 			"privateip": schema.StringAttribute{
 				MarkdownDescription: "Private IP",
 				Computed:            true,
+				PlanModifiers:       []planmodifier.String{modifiers.UseStateForUnknownIf(notReplacedOnUpdate)},
 			},
 			"cmd": schema.ListAttribute{
 				MarkdownDescription: "cmd",
@@ -115,34 +199,135 @@ func (flyMachineResource) Schema(_ context.Context, _ resource.SchemaRequest, re
 				// Computed:            true,
 				ElementType: types.StringType,
 			},
+			"tty": schema.BoolAttribute{
+				MarkdownDescription: "Allocate a tty for the init process",
+				Optional:            true,
+				Computed:            true,
+				PlanModifiers:       []planmodifier.Bool{modifiers.BoolDefault(false)},
+			},
+			"swap_size_mb": schema.Int64Attribute{
+				MarkdownDescription: "Size of swap space to create, in mb",
+				Optional:            true,
+				Computed:            true,
+				PlanModifiers:       []planmodifier.Int64{modifiers.Int64Default(0)},
+			},
+			"kernel_args": schema.ListAttribute{
+				MarkdownDescription: "Extra arguments passed to the guest kernel",
+				Optional:            true,
+				ElementType:         types.StringType,
+			},
+			"dns": schema.SingleNestedAttribute{
+				MarkdownDescription: "Guest dns settings",
+				Optional:            true,
+				Attributes: map[string]schema.Attribute{
+					"skip_registration": schema.BoolAttribute{
+						MarkdownDescription: "Don't register the machine in the app's internal dns",
+						Optional:            true,
+						Computed:            true,
+						PlanModifiers:       []planmodifier.Bool{modifiers.BoolDefault(false)},
+					},
+					"nameservers": schema.ListAttribute{
+						MarkdownDescription: "Nameservers to use instead of the fly internal resolver",
+						Optional:            true,
+						ElementType:         types.StringType,
+					},
+				},
+			},
+			"standbys": schema.ListAttribute{
+				MarkdownDescription: "IDs of machines this machine is a standby for. Reference the other machines' `id` so they are created first",
+				Optional:            true,
+				ElementType:         types.StringType,
+			},
 			"image": schema.StringAttribute{
-				MarkdownDescription: "docker image",
-				Required:            true,
+				MarkdownDescription: "docker image, required unless the machine runs `containers`",
+				Optional:            true,
+				Computed:            true,
+				PlanModifiers:       []planmodifier.String{modifiers.UseStateForUnknownIf(containersUnchanged)},
 			},
 			"cputype": schema.StringAttribute{
 				MarkdownDescription: "cpu type",
 				Computed:            true,
 				Optional:            true,
+				PlanModifiers:       []planmodifier.String{modifiers.StringDefault("shared")},
 			},
 			"cpus": schema.Int64Attribute{
 				MarkdownDescription: "cpu count",
 				Computed:            true,
 				Optional:            true,
+				PlanModifiers:       []planmodifier.Int64{modifiers.Int64Default(1)},
 			},
 			"memorymb": schema.Int64Attribute{
 				MarkdownDescription: "memory mb",
 				Computed:            true,
 				Optional:            true,
+				PlanModifiers:       []planmodifier.Int64{modifiers.Int64Default(256)},
 			},
 			"env": schema.MapAttribute{
 				MarkdownDescription: "Optional environment variables, keys and values must be strings",
 				Optional:            true,
 				Computed:            true,
 				ElementType:         types.StringType,
+				PlanModifiers:       []planmodifier.Map{modifiers.MapDefault(types.MapValueMust(types.StringType, map[string]attr.Value{}))},
+			},
+			"readiness": schema.SingleNestedAttribute{
+				MarkdownDescription: "Probe the machine over its private ip after create and update, and wait until it answers",
+				Optional:            true,
+				Attributes: map[string]schema.Attribute{
+					"port": schema.Int64Attribute{
+						MarkdownDescription: "Port to probe",
+						Required:            true,
+					},
+					"path": schema.StringAttribute{
+						MarkdownDescription: "Path to request over http. Without a path the probe only opens a tcp connection",
+						Optional:            true,
+					},
+					"expected_status": schema.Int64Attribute{
+						MarkdownDescription: "Http status the probe expects, defaults to 200",
+						Optional:            true,
+					},
+					"timeout": schema.StringAttribute{
+						MarkdownDescription: "How long to keep probing, as a duration like `90s`, defaults to `60s`",
+						Optional:            true,
+					},
+				},
+			},
+			"update_strategy": schema.StringAttribute{
+				MarkdownDescription: "How config changes are applied: `in_place` updates the running machine, `stop_then_update` stops it first and `replace` creates a new machine and destroys the old one",
+				Optional:            true,
+				Computed:            true,
+				PlanModifiers:       []planmodifier.String{modifiers.StringDefault(updateStrategyInPlace)},
+			},
+			"auto_rollback": schema.BoolAttribute{
+				MarkdownDescription: "Restore the previous config if the updated machine doesn't start or its health checks fail",
+				Optional:            true,
+				Computed:            true,
+				PlanModifiers:       []planmodifier.Bool{modifiers.BoolDefault(false)},
+			},
+			"force_destroy": schema.BoolAttribute{
+				MarkdownDescription: "Kill the machine and force its deletion on destroy instead of waiting for it to stop",
+				Optional:            true,
+				Computed:            true,
+				PlanModifiers:       []planmodifier.Bool{modifiers.BoolDefault(false)},
+			},
+			"secret_env": schema.MapAttribute{
+				MarkdownDescription: "Environment variables that are kept out of plan output and `env`, keys and values must be strings",
+				Optional:            true,
+				Sensitive:           true,
+				ElementType:         types.StringType,
+			},
+			"ignore_env_keys": schema.ListAttribute{
+				MarkdownDescription: "Env keys managed outside terraform, in addition to the provider's `ignore_env_keys`. They are left out of `env` and kept as they are on update. A trailing `*` matches any key with that prefix",
+				Optional:            true,
+				Computed:            true,
+				ElementType:         types.StringType,
+				PlanModifiers:       []planmodifier.List{modifiers.ListDefault(types.ListValueMust(types.StringType, []attr.Value{}))},
 			},
 			"mounts": schema.ListNestedAttribute{
-				MarkdownDescription: "Volume mounts",
+				MarkdownDescription: "Volume mounts. Volumes are attached when a machine is created, so adding or removing one replaces the machine",
 				Optional:            true,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.RequiresReplaceIf(mountCountChanged, "Adding or removing a mount replaces the machine", "Adding or removing a mount replaces the machine"),
+				},
 				NestedObject: schema.NestedAttributeObject{
 					Attributes: map[string]schema.Attribute{
 						"encrypted": schema.BoolAttribute{
@@ -159,7 +344,128 @@ func (flyMachineResource) Schema(_ context.Context, _ resource.SchemaRequest, re
 						},
 						"volume": schema.StringAttribute{
 							Required:            true,
-							MarkdownDescription: "Name or ID of volume",
+							MarkdownDescription: "Name or ID of volume. A name is looked up among the app's volumes in the machine's region and must match exactly one volume that isn't attached to another machine. Mounting a different volume at a path replaces the machine",
+						},
+						"volume_id": schema.StringAttribute{
+							Computed:            true,
+							MarkdownDescription: "ID of the mounted volume",
+							PlanModifiers:       []planmodifier.String{stringplanmodifier.UseStateForUnknown()},
+						},
+					},
+				},
+			},
+			"containers": schema.ListNestedAttribute{
+				MarkdownDescription: "Containers to run in place of the top-level `image`, e.g. an app alongside its sidecars",
+				Optional:            true,
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"name": schema.StringAttribute{
+							MarkdownDescription: "Container name, unique within the machine",
+							Required:            true,
+						},
+						"image": schema.StringAttribute{
+							MarkdownDescription: "docker image",
+							Required:            true,
+						},
+						"cmd": schema.ListAttribute{
+							MarkdownDescription: "cmd",
+							Optional:            true,
+							ElementType:         types.StringType,
+						},
+						"entrypoint": schema.ListAttribute{
+							MarkdownDescription: "image entrypoint",
+							Optional:            true,
+							ElementType:         types.StringType,
+						},
+						"env": schema.MapAttribute{
+							MarkdownDescription: "Environment variables of the container, keys and values must be strings",
+							Optional:            true,
+							ElementType:         types.StringType,
+						},
+						"files": schema.ListNestedAttribute{
+							MarkdownDescription: "Files written into the container before it starts",
+							Optional:            true,
+							NestedObject: schema.NestedAttributeObject{
+								Attributes: map[string]schema.Attribute{
+									"guest_path": schema.StringAttribute{
+										MarkdownDescription: "Path of the file in the container",
+										Required:            true,
+									},
+									"raw_value": schema.StringAttribute{
+										MarkdownDescription: "Contents of the file",
+										Optional:            true,
+									},
+									"secret_name": schema.StringAttribute{
+										MarkdownDescription: "App secret to take the contents of the file from",
+										Optional:            true,
+									},
+								},
+							},
+						},
+						"healthchecks": schema.ListNestedAttribute{
+							MarkdownDescription: "Container health checks, each sets exactly one of `exec`, `http` or `tcp`",
+							Optional:            true,
+							NestedObject: schema.NestedAttributeObject{
+								Attributes: map[string]schema.Attribute{
+									"name": schema.StringAttribute{
+										Optional: true,
+									},
+									"exec": schema.ListAttribute{
+										MarkdownDescription: "Command run in the container, the check passes when it exits 0",
+										Optional:            true,
+										ElementType:         types.StringType,
+									},
+									"http": schema.SingleNestedAttribute{
+										MarkdownDescription: "http request to the container",
+										Optional:            true,
+										Attributes: map[string]schema.Attribute{
+											"port": schema.Int64Attribute{
+												Required: true,
+											},
+											"path": schema.StringAttribute{
+												Optional: true,
+											},
+										},
+									},
+									"tcp": schema.SingleNestedAttribute{
+										MarkdownDescription: "tcp connection to the container",
+										Optional:            true,
+										Attributes: map[string]schema.Attribute{
+											"port": schema.Int64Attribute{
+												Required: true,
+											},
+										},
+									},
+									"interval": schema.Int64Attribute{
+										MarkdownDescription: "Seconds between checks",
+										Optional:            true,
+									},
+									"timeout": schema.Int64Attribute{
+										MarkdownDescription: "Seconds a check gets to pass",
+										Optional:            true,
+									},
+									"failure_threshold": schema.Int64Attribute{
+										MarkdownDescription: "Failed checks before the container is unhealthy",
+										Optional:            true,
+									},
+								},
+							},
+						},
+						"depends_on": schema.ListNestedAttribute{
+							MarkdownDescription: "Containers that have to reach a condition before this one starts",
+							Optional:            true,
+							NestedObject: schema.NestedAttributeObject{
+								Attributes: map[string]schema.Attribute{
+									"name": schema.StringAttribute{
+										MarkdownDescription: "Name of the other container",
+										Required:            true,
+									},
+									"condition": schema.StringAttribute{
+										MarkdownDescription: "One of `started`, `healthy` or `exited_successfully`",
+										Optional:            true,
+									},
+								},
+							},
 						},
 					},
 				},
@@ -201,14 +507,6 @@ func (flyMachineResource) Schema(_ context.Context, _ resource.SchemaRequest, re
 	}
 }
 
-func (mr flyMachineResource) ValidateOpenTunnel() (bool, error) {
-	_, err := mr.httpClient.R().Get(fmt.Sprintf("http://%s", mr.httpEndpoint))
-	if err != nil {
-		return false, errors.New("can't connect to the api, is the tunnel open? :)")
-	}
-	return true, nil
-}
-
 func TfServicesToServices(input []TfService) []apiv1.Service {
 	services := make([]apiv1.Service, 0)
 	for _, s := range input {
@@ -255,6 +553,365 @@ func ServicesToTfServices(input []apiv1.Service) []TfService {
 	return tfservices
 }
 
+func (mr flyMachineResource) ValidateConfig(ctx context.Context, req resource.ValidateConfigRequest, resp *resource.ValidateConfigResponse) {
+	var readinessTimeout types.String
+	resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root("readiness").AtName("timeout"), &readinessTimeout)...)
+	if _, err := (TfMachineReadiness{Timeout: readinessTimeout}).timeout(); err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("readiness").AtName("timeout"), "Invalid readiness timeout", err.Error())
+	}
+
+	var env, secretEnv types.Map
+	resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root("env"), &env)...)
+	resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root("secret_env"), &secretEnv)...)
+	for k := range secretEnv.Elements() {
+		if _, ok := env.Elements()[k]; ok {
+			resp.Diagnostics.AddAttributeError(path.Root("secret_env").AtMapKey(k), "Duplicate environment variable", fmt.Sprintf("%s is set in both env and secret_env", k))
+		}
+	}
+
+	var image types.String
+	var containers types.List
+	resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root("image"), &image)...)
+	resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root("containers"), &containers)...)
+	if !containers.IsUnknown() {
+		var tfcontainers []TfMachineContainer
+		// Containers with values that aren't known yet are checked once they are.
+		if !containers.ElementsAs(ctx, &tfcontainers, false).HasError() {
+			validateContainers(image, tfcontainers, &resp.Diagnostics)
+		}
+	}
+
+	var strategy types.String
+	resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root("update_strategy"), &strategy)...)
+	if !strategy.IsNull() && !strategy.IsUnknown() && !contains(updateStrategies, strategy.ValueString()) {
+		resp.Diagnostics.AddAttributeError(path.Root("update_strategy"), "Invalid update strategy", fmt.Sprintf("update_strategy must be one of %s, got %q", strings.Join(updateStrategies, ", "), strategy.ValueString()))
+	}
+}
+
+// ModifyPlan replaces the machine when a mount gets a different volume. Mounts are matched with the prior ones by
+// path, and a volume's name and id are the same volume, so reordering mounts or switching between the two doesn't.
+func (mr flyMachineResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	if req.State.Raw.IsNull() || req.Plan.Raw.IsNull() {
+		return
+	}
+
+	var plannedList, priorList types.List
+	resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, path.Root("mounts"), &plannedList)...)
+	resp.Diagnostics.Append(req.State.GetAttribute(ctx, path.Root("mounts"), &priorList)...)
+	if resp.Diagnostics.HasError() || plannedList.IsNull() || plannedList.IsUnknown() || len(plannedList.Elements()) != len(priorList.Elements()) {
+		// Added or removed mounts are left to mountCountChanged.
+		return
+	}
+	var planned, prior []TfMachineMount
+	resp.Diagnostics.Append(plannedList.ElementsAs(ctx, &planned, false)...)
+	resp.Diagnostics.Append(priorList.ElementsAs(ctx, &prior, false)...)
+
+	var app, region, id types.String
+	resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, path.Root("app"), &app)...)
+	resp.Diagnostics.Append(req.State.GetAttribute(ctx, path.Root("placed_region"), &region)...)
+	resp.Diagnostics.Append(req.State.GetAttribute(ctx, path.Root("id"), &id)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	if region.ValueString() == "" {
+		resp.Diagnostics.Append(req.State.GetAttribute(ctx, path.Root("region"), &region)...)
+	}
+
+	var volumes []apiv1.Volume
+	var listErr error
+	resolve := func(ref string) (string, error) {
+		if volumes == nil && listErr == nil {
+			volumes, listErr = apiv1.NewMachineAPI(&mr.httpClient, mr.httpEndpoint).ListVolumes(app.ValueString())
+		}
+		if listErr != nil {
+			return "", listErr
+		}
+		return resolveVolume(volumes, ref, region.ValueString(), id.ValueString())
+	}
+	for _, i := range replacedMounts(planned, prior, resolve) {
+		resp.RequiresReplace = append(resp.RequiresReplace, path.Root("mounts").AtListIndex(i).AtName("volume"))
+	}
+	resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("mounts"), planned)...)
+}
+
+// createAttempts is how many times Create sends the create request before giving up.
+const createAttempts = 3
+
+// waitFailedEventCount is how many of the machine's most recent events are reported when waiting for it fails.
+const waitFailedEventCount = 5
+
+// addWaitFailedWarning reads the machine back after a failed wait and reports its recent events,
+// so that a crash-looping machine shows why in the apply output.
+func addWaitFailedWarning(machineAPI *apiv1.MachineAPI, app string, id string, waitErr error, diags *diag.Diagnostics) {
+	var machine apiv1.MachineResponse
+	_, err := machineAPI.ReadMachine(app, id, &machine)
+	if err != nil || len(machine.Events) == 0 {
+		diags.AddWarning("Machine did not reach the started state", waitErr.Error())
+		return
+	}
+
+	events := machine.Events
+	if len(events) > waitFailedEventCount {
+		events = events[:waitFailedEventCount]
+	}
+	lines := []string{waitErr.Error(), "", "Recent machine events:"}
+	for _, e := range events {
+		line := fmt.Sprintf("%s %s %s (source: %s)", e.Time().UTC().Format(time.RFC3339), e.Type, e.Status, e.Source)
+		if code, ok := e.ExitCode(); ok {
+			line += fmt.Sprintf(", exit code %d", code)
+		}
+		lines = append(lines, line)
+	}
+	diags.AddWarning("Machine did not reach the started state", strings.Join(lines, "\n"))
+}
+
+// checkStandbys makes sure every machine listed in standbys exists in the app, so a typo or a
+// machine destroyed out of band is reported before the machine is created or updated.
+func checkStandbys(machineAPI *apiv1.MachineAPI, app string, standbys []string, diags *diag.Diagnostics) {
+	for _, id := range standbys {
+		var machine apiv1.MachineResponse
+		readResponse, err := machineAPI.ReadMachine(app, id, &machine)
+		if err != nil {
+			diags.AddError("Failed to look up standby target", err.Error())
+			continue
+		}
+		if readResponse.StatusCode != http.StatusOK {
+			diags.AddError("Standby target not found", fmt.Sprintf("Machine %s in app %s could not be read: %s", id, app, readResponse.Status))
+		}
+	}
+}
+
+// configuredRegion keeps the configured region in state when the machine was placed in one of its
+// fallbacks, so that a fallback placement doesn't show up as a diff. placed_region has the real one.
+func configuredRegion(configured types.String, fallbacks []string, placed string) types.String {
+	if configured.IsNull() || configured.IsUnknown() {
+		return types.StringValue(placed)
+	}
+	if configured.ValueString() != placed && !contains(fallbacks, placed) {
+		return types.StringValue(placed)
+	}
+	return configured
+}
+
+// placementConfig builds the placement hints of a new machine. They are only used when the machine is placed, so
+// changing them replaces it.
+func placementConfig(preferZone types.String, avoidZone types.String) *apiv1.PlacementConfig {
+	if preferZone.IsNull() && avoidZone.IsNull() {
+		return nil
+	}
+	return &apiv1.PlacementConfig{
+		PreferZone: preferZone.ValueString(),
+		AvoidZone:  avoidZone.ValueString(),
+	}
+}
+
+func optionalString(value string) types.String {
+	if value == "" {
+		return types.StringNull()
+	}
+	return types.StringValue(value)
+}
+
+// envKeyIgnored reports whether key matches one of the ignore_env_keys patterns.
+func envKeyIgnored(key string, patterns []string) bool {
+	for _, p := range patterns {
+		if p == key || (strings.HasSuffix(p, "*") && strings.HasPrefix(key, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoredEnvKeys combines the provider's ignore_env_keys with the resource's.
+func (mr flyMachineResource) ignoredEnvKeys(resourceKeys []string) []string {
+	keys := make([]string, 0, len(mr.ignoreEnvKeys)+len(resourceKeys))
+	keys = append(keys, mr.ignoreEnvKeys...)
+	return append(keys, resourceKeys...)
+}
+
+// withoutIgnoredEnv drops keys matching patterns from the machine's env, unless they are set in env or secretEnv.
+func withoutIgnoredEnv(env map[string]string, patterns []string, configured types.Map, configuredSecrets types.Map) map[string]string {
+	if len(patterns) == 0 {
+		return env
+	}
+	filtered := map[string]string{}
+	for k, v := range env {
+		_, isEnv := configured.Elements()[k]
+		_, isSecret := configuredSecrets.Elements()[k]
+		if isEnv || isSecret || !envKeyIgnored(k, patterns) {
+			filtered[k] = v
+		}
+	}
+	return filtered
+}
+
+// mergeSecretEnv adds secret_env to the env sent to the api, the machine itself only has one env.
+func mergeSecretEnv(env map[string]string, secretEnv types.Map) map[string]string {
+	if secretEnv.IsNull() || secretEnv.IsUnknown() {
+		return env
+	}
+	var secrets map[string]string
+	secretEnv.ElementsAs(context.Background(), &secrets, false)
+	merged := map[string]string{}
+	for k, v := range env {
+		merged[k] = v
+	}
+	for k, v := range secrets {
+		merged[k] = v
+	}
+	return merged
+}
+
+// splitEnv separates the machine's env back into env and secret_env, using the keys of the known secretEnv.
+func splitEnv(env map[string]string, secretEnv types.Map) (types.Map, types.Map) {
+	if secretEnv.IsNull() || secretEnv.IsUnknown() {
+		return utils.KVToTfMap(env, types.StringType), secretEnv
+	}
+	plain := map[string]string{}
+	secrets := map[string]string{}
+	for k, v := range env {
+		if _, ok := secretEnv.Elements()[k]; ok {
+			secrets[k] = v
+		} else {
+			plain[k] = v
+		}
+	}
+	return utils.KVToTfMap(plain, types.StringType), utils.KVToTfMap(secrets, types.StringType)
+}
+
+func TfDnsToDns(input *TfMachineDns) *apiv1.DNSConfig {
+	if input == nil {
+		return nil
+	}
+	return &apiv1.DNSConfig{
+		SkipRegistration: input.SkipRegistration.ValueBool(),
+		Nameservers:      input.Nameservers,
+	}
+}
+
+// DnsToTfDns converts the machine's dns settings, which the api reports even when they are all defaults. Those are
+// only kept when dns is set in configured, so that an empty or all default dns block doesn't disappear from state.
+func DnsToTfDns(input *apiv1.DNSConfig, configured *TfMachineDns) *TfMachineDns {
+	if configured == nil && (input == nil || (!input.SkipRegistration && len(input.Nameservers) == 0)) {
+		return nil
+	}
+	dns := &TfMachineDns{SkipRegistration: types.BoolValue(false)}
+	if input != nil {
+		dns.SkipRegistration = types.BoolValue(input.SkipRegistration)
+		dns.Nameservers = input.Nameservers
+	}
+	if configured != nil && len(dns.Nameservers) == 0 && len(configured.Nameservers) == 0 {
+		dns.Nameservers = configured.Nameservers
+	}
+	return dns
+}
+
+func MountsToTfMounts(input []apiv1.MachineMount) []TfMachineMount {
+	var tfmounts []TfMachineMount
+	for _, m := range input {
+		tfmounts = append(tfmounts, TfMachineMount{
+			Encrypted: types.BoolValue(m.Encrypted),
+			Path:      types.StringValue(m.Path),
+			SizeGb:    types.Int64Value(int64(m.SizeGb)),
+			Volume:    types.StringValue(m.Volume),
+			VolumeId:  types.StringValue(m.Volume),
+		})
+	}
+	return tfmounts
+}
+
+// orderServicesLike puts services in the order of prior, matching them by internal port and protocol, so that the
+// api returning services, ports or handlers in a different order isn't reported as a change. Services that aren't
+// in prior are kept at the end in api order.
+func orderServicesLike(services []TfService, prior []TfService) []TfService {
+	if len(prior) == 0 {
+		return services
+	}
+	ordered := make([]TfService, 0, len(services))
+	used := make([]bool, len(services))
+	for _, p := range prior {
+		for i, s := range services {
+			if !used[i] && s.InternalPort.Equal(p.InternalPort) && s.Protocol.Equal(p.Protocol) {
+				s.Ports = orderPortsLike(s.Ports, p.Ports)
+				ordered = append(ordered, s)
+				used[i] = true
+				break
+			}
+		}
+	}
+	for i, s := range services {
+		if !used[i] {
+			ordered = append(ordered, s)
+		}
+	}
+	return ordered
+}
+
+func orderPortsLike(ports []TfPort, prior []TfPort) []TfPort {
+	ordered := make([]TfPort, 0, len(ports))
+	used := make([]bool, len(ports))
+	for _, p := range prior {
+		for i, port := range ports {
+			if !used[i] && port.Port.Equal(p.Port) {
+				if sameHandlers(port.Handlers, p.Handlers) {
+					port.Handlers = p.Handlers
+				}
+				ordered = append(ordered, port)
+				used[i] = true
+				break
+			}
+		}
+	}
+	for i, port := range ports {
+		if !used[i] {
+			ordered = append(ordered, port)
+		}
+	}
+	return ordered
+}
+
+// sameHandlers reports whether a and b hold the same handlers, in any order.
+func sameHandlers(a []types.String, b []types.String) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := map[string]int{}
+	for _, h := range a {
+		counts[h.ValueString()]++
+	}
+	for _, h := range b {
+		counts[h.ValueString()]--
+		if counts[h.ValueString()] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// orderMountsLike puts mounts in the order of prior, matching them by path.
+func orderMountsLike(mounts []TfMachineMount, prior []TfMachineMount) []TfMachineMount {
+	if len(mounts) == 0 || len(prior) == 0 {
+		return mounts
+	}
+	ordered := make([]TfMachineMount, 0, len(mounts))
+	used := make([]bool, len(mounts))
+	for _, p := range prior {
+		for i, m := range mounts {
+			if !used[i] && m.Path.Equal(p.Path) {
+				ordered = append(ordered, m)
+				used[i] = true
+				break
+			}
+		}
+	}
+	for i, m := range mounts {
+		if !used[i] {
+			ordered = append(ordered, m)
+		}
+	}
+	return ordered
+}
+
 func (mr flyMachineResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
 	_, err := mr.ValidateOpenTunnel()
 	if err != nil {
@@ -275,16 +932,23 @@ func (mr flyMachineResource) Create(ctx context.Context, req resource.CreateRequ
 		Name:   data.Name.ValueString(),
 		Region: data.Region.ValueString(),
 		Config: apiv1.MachineConfig{
-			Image:    data.Image.ValueString(),
-			Services: services,
+			Image:      data.Image.ValueString(),
+			Services:   services,
+			Containers: TfContainersToContainers(data.Containers),
 			Init: apiv1.InitConfig{
 				Cmd:        data.Cmd,
 				Entrypoint: data.Entrypoint,
 				Exec:       data.Exec,
+				KernelArgs: data.KernelArgs,
 			},
+			Standbys: data.Standbys,
+			DNS:      TfDnsToDns(data.Dns),
 		},
 	}
 
+	createReq.Config.Guest.HostDedicationID = data.HostDedicationId.ValueString()
+	createReq.Placement = placementConfig(data.PreferZone, data.AvoidZone)
+
 	if !data.Cpus.IsUnknown() {
 		createReq.Config.Guest.Cpus = int(data.Cpus.ValueInt64())
 	}
@@ -294,78 +958,127 @@ func (mr flyMachineResource) Create(ctx context.Context, req resource.CreateRequ
 	if !data.MemoryMb.IsUnknown() {
 		createReq.Config.Guest.MemoryMb = int(data.MemoryMb.ValueInt64())
 	}
+	if !data.Tty.IsUnknown() {
+		createReq.Config.Init.Tty = data.Tty.ValueBool()
+	}
+	if !data.SwapSizeMb.IsUnknown() {
+		createReq.Config.Init.SwapSizeMb = int(data.SwapSizeMb.ValueInt64())
+	}
 
 	if !data.Env.IsUnknown() {
 		var env map[string]string
 		data.Env.ElementsAs(context.Background(), &env, false)
 		createReq.Config.Env = env
 	}
-	if len(data.Mounts) > 0 {
-		var mounts []apiv1.MachineMount
+	createReq.Config.Env = mergeSecretEnv(createReq.Config.Env, data.SecretEnv)
+
+	machineAPI := apiv1.NewMachineAPI(&mr.httpClient, mr.httpEndpoint)
+
+	checkStandbys(machineAPI, data.App.ValueString(), data.Standbys, &resp.Diagnostics)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	var newMachine apiv1.MachineResponse
+	idempotencyKey := uuid.New().String()
+	for i, region := range append([]string{data.Region.ValueString()}, data.RegionFallbacks...) {
+		// Volumes belong to a region, so the mounts are looked up again in each region that is tried.
+		if resolveErr := resolveMounts(machineAPI, data.App.ValueString(), region, "", data.Mounts); resolveErr != nil {
+			if i == 0 {
+				resp.Diagnostics.AddError("Failed to resolve volume", resolveErr.Error())
+				return
+			}
+			tflog.Info(ctx, fmt.Sprintf("not falling back to region %s: %s", region, resolveErr))
+			continue
+		}
+		createReq.Config.Mounts = nil
 		for _, m := range data.Mounts {
-			mounts = append(mounts, apiv1.MachineMount{
+			createReq.Config.Mounts = append(createReq.Config.Mounts, apiv1.MachineMount{
 				Encrypted: m.Encrypted.ValueBool(),
 				Path:      m.Path.ValueString(),
 				SizeGb:    int(m.SizeGb.ValueInt64()),
-				Volume:    m.Volume.ValueString(),
+				Volume:    m.VolumeId.ValueString(),
 			})
 		}
-		createReq.Config.Mounts = mounts
-	}
 
-	machineAPI := apiv1.NewMachineAPI(mr.httpClient, mr.httpEndpoint)
-
-	var newMachine apiv1.MachineResponse
-	err = machineAPI.CreateMachine(createReq, data.App.ValueString(), &newMachine)
+		createReq.Region = region
+		err = machineAPI.CreateMachineIdempotent(ctx, createReq, data.App.ValueString(), idempotencyKey, createAttempts, &newMachine)
+		if err == nil || !apiv1.IsCapacityError(err) {
+			break
+		}
+		tflog.Info(ctx, fmt.Sprintf("region %s is out of capacity: %s", region, err))
+	}
 	if err != nil {
 		resp.Diagnostics.AddError("Failed to create machine", err.Error())
 		return
 	}
 
-	tflog.Info(ctx, fmt.Sprintf("%+v", newMachine))
+	tflog.Info(ctx, fmt.Sprintf("created machine %s (instance %s) in %s", newMachine.ID, newMachine.InstanceID, newMachine.Region))
 
-	env := utils.KVToTfMap(newMachine.Config.Env, types.StringType)
+	// Record the machine as soon as it exists, so that if anything below fails terraform
+	// keeps track of it (as tainted) instead of leaving an orphan behind.
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("id"), newMachine.ID)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("app"), data.App)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
-	tfservices := ServicesToTfServices(newMachine.Config.Services)
+	env, secretEnv := splitEnv(withoutIgnoredEnv(newMachine.Config.Env, mr.ignoredEnvKeys(data.IgnoreEnvKeys), data.Env, data.SecretEnv), data.SecretEnv)
+
+	tfservices := orderServicesLike(ServicesToTfServices(newMachine.Config.Services), data.Services)
+	tfmounts := keepConfiguredVolumes(orderMountsLike(MountsToTfMounts(newMachine.Config.Mounts), data.Mounts), data.Mounts)
 
 	if data.Services == nil && len(tfservices) == 0 {
 		tfservices = nil
 	}
 
 	data = flyMachineResourceData{
-		Name:       types.StringValue(newMachine.Name),
-		Region:     types.StringValue(newMachine.Region),
-		Id:         types.StringValue(newMachine.ID),
-		App:        types.StringValue(data.App.ValueString()),
-		PrivateIP:  types.StringValue(newMachine.PrivateIP),
-		Image:      types.StringValue(newMachine.Config.Image),
-		Cpus:       types.Int64Value(int64(newMachine.Config.Guest.Cpus)),
-		MemoryMb:   types.Int64Value(int64(newMachine.Config.Guest.MemoryMb)),
-		CpuType:    types.StringValue(newMachine.Config.Guest.CPUKind),
-		Cmd:        newMachine.Config.Init.Cmd,
-		Entrypoint: newMachine.Config.Init.Entrypoint,
-		Exec:       newMachine.Config.Init.Exec,
-		Env:        env,
-		Services:   tfservices,
-	}
-
-	if len(newMachine.Config.Mounts) > 0 {
-		var tfmounts []TfMachineMount
-		for _, m := range newMachine.Config.Mounts {
-			tfmounts = append(tfmounts, TfMachineMount{
-				Encrypted: types.BoolValue(m.Encrypted),
-				Path:      types.StringValue(m.Path),
-				SizeGb:    types.Int64Value(int64(m.SizeGb)),
-				Volume:    types.StringValue(m.Volume),
-			})
-		}
-		data.Mounts = tfmounts
+		Name:             types.StringValue(newMachine.Name),
+		Region:           configuredRegion(data.Region, data.RegionFallbacks, newMachine.Region),
+		Id:               types.StringValue(newMachine.ID),
+		App:              types.StringValue(data.App.ValueString()),
+		PrivateIP:        types.StringValue(newMachine.PrivateIP),
+		Image:            types.StringValue(newMachine.Config.Image),
+		Cpus:             types.Int64Value(int64(newMachine.Config.Guest.Cpus)),
+		MemoryMb:         types.Int64Value(int64(newMachine.Config.Guest.MemoryMb)),
+		CpuType:          types.StringValue(newMachine.Config.Guest.CPUKind),
+		Cmd:              newMachine.Config.Init.Cmd,
+		Entrypoint:       newMachine.Config.Init.Entrypoint,
+		Exec:             newMachine.Config.Init.Exec,
+		Standbys:         newMachine.Config.Standbys,
+		Tty:              types.BoolValue(newMachine.Config.Init.Tty),
+		SwapSizeMb:       types.Int64Value(int64(newMachine.Config.Init.SwapSizeMb)),
+		KernelArgs:       newMachine.Config.Init.KernelArgs,
+		Dns:              DnsToTfDns(newMachine.Config.DNS, data.Dns),
+		Containers:       ContainersToTfContainers(newMachine.Config.Containers),
+		RegionFallbacks:  data.RegionFallbacks,
+		PlacedRegion:     types.StringValue(newMachine.Region),
+		HostDedicationId: optionalString(newMachine.Config.Guest.HostDedicationID),
+		PreferZone:       data.PreferZone,
+		AvoidZone:        data.AvoidZone,
+		Readiness:        data.Readiness,
+		UpdateStrategy:   data.UpdateStrategy,
+		AutoRollback:     data.AutoRollback,
+		ForceDestroy:     data.ForceDestroy,
+		Env:              env,
+		SecretEnv:        secretEnv,
+		IgnoreEnvKeys:    data.IgnoreEnvKeys,
+		Services:         tfservices,
+		Mounts:           tfmounts,
 	}
 
 	err = machineAPI.WaitForMachine(data.App.ValueString(), data.Id.ValueString(), newMachine.InstanceID)
 	if err != nil {
 		// FIXME(?): For now we just assume that the orchestrator is in fact going to faithfully execute our request
 		tflog.Info(ctx, "Waiting errored")
+		addWaitFailedWarning(machineAPI, data.App.ValueString(), data.Id.ValueString(), err, &resp.Diagnostics)
+	}
+
+	if data.Readiness != nil {
+		err = mr.waitForReadiness(ctx, data.PrivateIP.ValueString(), *data.Readiness)
+		if err != nil {
+			resp.Diagnostics.AddError("Machine did not become ready", err.Error())
+		}
 	}
 
 	diags = resp.State.Set(ctx, &data)
@@ -386,7 +1099,7 @@ func (mr flyMachineResource) Read(ctx context.Context, req resource.ReadRequest,
 	diags := req.State.Get(ctx, &data)
 	resp.Diagnostics.Append(diags...)
 
-	machineAPI := apiv1.NewMachineAPI(mr.httpClient, mr.httpEndpoint)
+	machineAPI := apiv1.NewMachineAPI(&mr.httpClient, mr.httpEndpoint)
 
 	var machine apiv1.MachineResponse
 
@@ -396,42 +1109,62 @@ func (mr flyMachineResource) Read(ctx context.Context, req resource.ReadRequest,
 		return
 	}
 
-	env := utils.KVToTfMap(machine.Config.Env, types.StringType)
+	env, secretEnv := splitEnv(withoutIgnoredEnv(machine.Config.Env, mr.ignoredEnvKeys(data.IgnoreEnvKeys), data.Env, data.SecretEnv), data.SecretEnv)
+	if data.IgnoreEnvKeys == nil {
+		// Imported machines and ones created before ignore_env_keys had a default.
+		data.IgnoreEnvKeys = []string{}
+	}
 
-	tfservices := ServicesToTfServices(machine.Config.Services)
+	tfservices := orderServicesLike(ServicesToTfServices(machine.Config.Services), data.Services)
+	tfmounts := keepConfiguredVolumes(orderMountsLike(MountsToTfMounts(machine.Config.Mounts), data.Mounts), data.Mounts)
 
 	if data.Services == nil && len(tfservices) == 0 {
 		tfservices = nil
 	}
 
 	data = flyMachineResourceData{
-		Name:       types.StringValue(machine.Name),
-		Id:         types.StringValue(machine.ID),
-		Region:     types.StringValue(machine.Region),
-		App:        types.StringValue(data.App.ValueString()),
-		PrivateIP:  types.StringValue(machine.PrivateIP),
-		Image:      types.StringValue(machine.Config.Image),
-		Cpus:       types.Int64Value(int64(machine.Config.Guest.Cpus)),
-		MemoryMb:   types.Int64Value(int64(machine.Config.Guest.MemoryMb)),
-		CpuType:    types.StringValue(machine.Config.Guest.CPUKind),
-		Cmd:        machine.Config.Init.Cmd,
-		Entrypoint: machine.Config.Init.Entrypoint,
-		Exec:       machine.Config.Init.Exec,
-		Env:        env,
-		Services:   tfservices,
-	}
-
-	if len(machine.Config.Mounts) > 0 {
-		var tfmounts []TfMachineMount
-		for _, m := range machine.Config.Mounts {
-			tfmounts = append(tfmounts, TfMachineMount{
-				Encrypted: types.BoolValue(m.Encrypted),
-				Path:      types.StringValue(m.Path),
-				SizeGb:    types.Int64Value(int64(m.SizeGb)),
-				Volume:    types.StringValue(m.Volume),
-			})
-		}
-		data.Mounts = tfmounts
+		Name:             types.StringValue(machine.Name),
+		Id:               types.StringValue(machine.ID),
+		Region:           configuredRegion(data.Region, data.RegionFallbacks, machine.Region),
+		App:              types.StringValue(data.App.ValueString()),
+		PrivateIP:        types.StringValue(machine.PrivateIP),
+		Image:            types.StringValue(machine.Config.Image),
+		Cpus:             types.Int64Value(int64(machine.Config.Guest.Cpus)),
+		MemoryMb:         types.Int64Value(int64(machine.Config.Guest.MemoryMb)),
+		CpuType:          types.StringValue(machine.Config.Guest.CPUKind),
+		Cmd:              machine.Config.Init.Cmd,
+		Entrypoint:       machine.Config.Init.Entrypoint,
+		Exec:             machine.Config.Init.Exec,
+		Standbys:         machine.Config.Standbys,
+		Tty:              types.BoolValue(machine.Config.Init.Tty),
+		SwapSizeMb:       types.Int64Value(int64(machine.Config.Init.SwapSizeMb)),
+		KernelArgs:       machine.Config.Init.KernelArgs,
+		Dns:              DnsToTfDns(machine.Config.DNS, data.Dns),
+		Containers:       ContainersToTfContainers(machine.Config.Containers),
+		RegionFallbacks:  data.RegionFallbacks,
+		PlacedRegion:     types.StringValue(machine.Region),
+		HostDedicationId: optionalString(machine.Config.Guest.HostDedicationID),
+		PreferZone:       data.PreferZone,
+		AvoidZone:        data.AvoidZone,
+		Readiness:        data.Readiness,
+		UpdateStrategy:   data.UpdateStrategy,
+		AutoRollback:     data.AutoRollback,
+		ForceDestroy:     data.ForceDestroy,
+		Env:              env,
+		SecretEnv:        secretEnv,
+		IgnoreEnvKeys:    data.IgnoreEnvKeys,
+		Services:         tfservices,
+		Mounts:           tfmounts,
+	}
+
+	if data.UpdateStrategy.IsNull() {
+		data.UpdateStrategy = types.StringValue(updateStrategyInPlace)
+	}
+	if data.AutoRollback.IsNull() {
+		data.AutoRollback = types.BoolValue(false)
+	}
+	if data.ForceDestroy.IsNull() {
+		data.ForceDestroy = types.BoolValue(false)
 	}
 
 	diags = resp.State.Set(ctx, &data)
@@ -473,22 +1206,38 @@ func (mr flyMachineResource) Update(ctx context.Context, req resource.UpdateRequ
 		resp.Diagnostics.AddError("Can't mutate region of existing machine", "Can't switch region "+state.Name.ValueString()+" to "+plan.Name.ValueString())
 	}
 
+	// State written before placed_region existed only has the configured region.
+	placedRegion := state.PlacedRegion.ValueString()
+	if placedRegion == "" {
+		placedRegion = state.Region.ValueString()
+	}
+
 	services := TfServicesToServices(plan.Services)
 
 	updateReq := apiv1.MachineCreateOrUpdateRequest{
 		Name:   plan.Name.ValueString(),
-		Region: state.Region.ValueString(),
+		Region: placedRegion,
 		Config: apiv1.MachineConfig{
-			Image:    plan.Image.ValueString(),
-			Services: services,
+			Image:      plan.Image.ValueString(),
+			Services:   services,
+			Containers: TfContainersToContainers(plan.Containers),
 			Init: apiv1.InitConfig{
 				Cmd:        plan.Cmd,
 				Entrypoint: plan.Entrypoint,
 				Exec:       plan.Exec,
+				KernelArgs: plan.KernelArgs,
 			},
+			Standbys: plan.Standbys,
+			DNS:      TfDnsToDns(plan.Dns),
 		},
 	}
 
+	updateReq.Config.Guest.HostDedicationID = plan.HostDedicationId.ValueString()
+	if len(plan.Containers) > 0 {
+		// The image kept from state is the one the api reports, containers set their own.
+		updateReq.Config.Image = ""
+	}
+
 	if !plan.Cpus.IsUnknown() {
 		updateReq.Config.Guest.Cpus = int(plan.Cpus.ValueInt64())
 	}
@@ -498,6 +1247,12 @@ func (mr flyMachineResource) Update(ctx context.Context, req resource.UpdateRequ
 	if !plan.MemoryMb.IsUnknown() {
 		updateReq.Config.Guest.MemoryMb = int(plan.MemoryMb.ValueInt64())
 	}
+	if !plan.Tty.IsUnknown() {
+		updateReq.Config.Init.Tty = plan.Tty.ValueBool()
+	}
+	if !plan.SwapSizeMb.IsUnknown() {
+		updateReq.Config.Init.SwapSizeMb = int(plan.SwapSizeMb.ValueInt64())
+	}
 	if plan.Env.IsNull() {
 		env := map[string]string{}
 		updateReq.Config.Env = env
@@ -508,7 +1263,16 @@ func (mr flyMachineResource) Update(ctx context.Context, req resource.UpdateRequ
 	} else if !state.Env.IsUnknown() {
 		updateReq.Config.Env = map[string]string{}
 	}
+	updateReq.Config.Env = mergeSecretEnv(updateReq.Config.Env, plan.SecretEnv)
+	ignoreEnvKeys := mr.ignoredEnvKeys(plan.IgnoreEnvKeys)
 
+	machineApi := apiv1.NewMachineAPI(&mr.httpClient, mr.httpEndpoint)
+
+	err = resolveMounts(machineApi, state.App.ValueString(), placedRegion, state.Id.ValueString(), plan.Mounts)
+	if err != nil {
+		resp.Diagnostics.AddError("Failed to resolve volume", err.Error())
+		return
+	}
 	if len(plan.Mounts) > 0 {
 		var mounts []apiv1.MachineMount
 		for _, m := range plan.Mounts {
@@ -516,59 +1280,85 @@ func (mr flyMachineResource) Update(ctx context.Context, req resource.UpdateRequ
 				Encrypted: m.Encrypted.ValueBool(),
 				Path:      m.Path.ValueString(),
 				SizeGb:    int(m.SizeGb.ValueInt64()),
-				Volume:    m.Volume.ValueString(),
+				Volume:    m.VolumeId.ValueString(),
 			})
 		}
 		updateReq.Config.Mounts = mounts
 	}
 
-	machineApi := apiv1.NewMachineAPI(mr.httpClient, mr.httpEndpoint)
+	if len(ignoreEnvKeys) > 0 {
+		// Keys managed outside terraform aren't in the plan, send their current values so the update doesn't drop them.
+		var current apiv1.MachineResponse
+		_, err = machineApi.ReadMachine(state.App.ValueString(), state.Id.ValueString(), &current)
+		if err != nil {
+			resp.Diagnostics.AddError("Failed to read machine", err.Error())
+			return
+		}
+		for k, v := range current.Config.Env {
+			if _, ok := updateReq.Config.Env[k]; !ok && envKeyIgnored(k, ignoreEnvKeys) {
+				if updateReq.Config.Env == nil {
+					updateReq.Config.Env = map[string]string{}
+				}
+				updateReq.Config.Env[k] = v
+			}
+		}
+	}
 
-	var updatedMachine apiv1.MachineResponse
+	checkStandbys(machineApi, state.App.ValueString(), plan.Standbys, &resp.Diagnostics)
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
-	err = machineApi.UpdateMachine(updateReq, state.App.ValueString(), state.Id.ValueString(), &updatedMachine)
-	if err != nil {
-		resp.Diagnostics.AddError("Failed to update machine", err.Error())
+	var ready func(machine *apiv1.MachineResponse) error
+	if plan.Readiness != nil {
+		ready = func(machine *apiv1.MachineResponse) error {
+			return mr.waitForReadiness(ctx, machine.PrivateIP, *plan.Readiness)
+		}
+	}
+
+	updatedMachine := applyMachineUpdate(ctx, machineApi, plan.UpdateStrategy.ValueString(), plan.AutoRollback.ValueBool(), plan.ForceDestroy.ValueBool(), state.App.ValueString(), state.Id.ValueString(), updateReq, ready, &resp.Diagnostics)
+	if updatedMachine == nil {
 		return
 	}
 
-	env := utils.KVToTfMap(updatedMachine.Config.Env, types.StringType)
+	env, secretEnv := splitEnv(withoutIgnoredEnv(updatedMachine.Config.Env, mr.ignoredEnvKeys(plan.IgnoreEnvKeys), plan.Env, plan.SecretEnv), plan.SecretEnv)
 
-	tfservices := ServicesToTfServices(updatedMachine.Config.Services)
+	tfservices := orderServicesLike(ServicesToTfServices(updatedMachine.Config.Services), plan.Services)
+	tfmounts := keepConfiguredVolumes(orderMountsLike(MountsToTfMounts(updatedMachine.Config.Mounts), plan.Mounts), plan.Mounts)
 
 	state = flyMachineResourceData{
-		Name:       types.StringValue(updatedMachine.Name),
-		Region:     types.StringValue(updatedMachine.Region),
-		Id:         types.StringValue(updatedMachine.ID),
-		App:        types.StringValue(state.App.ValueString()),
-		PrivateIP:  types.StringValue(updatedMachine.PrivateIP),
-		Image:      types.StringValue(updatedMachine.Config.Image),
-		Cpus:       types.Int64Value(int64(updatedMachine.Config.Guest.Cpus)),
-		MemoryMb:   types.Int64Value(int64(updatedMachine.Config.Guest.MemoryMb)),
-		CpuType:    types.StringValue(updatedMachine.Config.Guest.CPUKind),
-		Cmd:        updatedMachine.Config.Init.Cmd,
-		Entrypoint: updatedMachine.Config.Init.Entrypoint,
-		Exec:       updatedMachine.Config.Init.Exec,
-		Env:        env,
-		Services:   tfservices,
-	}
-
-	if len(updatedMachine.Config.Mounts) > 0 {
-		var tfmounts []TfMachineMount
-		for _, m := range updatedMachine.Config.Mounts {
-			tfmounts = append(tfmounts, TfMachineMount{
-				Encrypted: types.BoolValue(m.Encrypted),
-				Path:      types.StringValue(m.Path),
-				SizeGb:    types.Int64Value(int64(m.SizeGb)),
-				Volume:    types.StringValue(m.Volume),
-			})
-		}
-		state.Mounts = tfmounts
-	}
-
-	err = machineApi.WaitForMachine(state.App.ValueString(), state.Id.ValueString(), updatedMachine.InstanceID)
-	if err != nil {
-		tflog.Info(ctx, "Waiting errored")
+		Name:             types.StringValue(updatedMachine.Name),
+		Region:           configuredRegion(plan.Region, plan.RegionFallbacks, updatedMachine.Region),
+		Id:               types.StringValue(updatedMachine.ID),
+		App:              types.StringValue(state.App.ValueString()),
+		PrivateIP:        types.StringValue(updatedMachine.PrivateIP),
+		Image:            types.StringValue(updatedMachine.Config.Image),
+		Cpus:             types.Int64Value(int64(updatedMachine.Config.Guest.Cpus)),
+		MemoryMb:         types.Int64Value(int64(updatedMachine.Config.Guest.MemoryMb)),
+		CpuType:          types.StringValue(updatedMachine.Config.Guest.CPUKind),
+		Cmd:              updatedMachine.Config.Init.Cmd,
+		Entrypoint:       updatedMachine.Config.Init.Entrypoint,
+		Exec:             updatedMachine.Config.Init.Exec,
+		Standbys:         updatedMachine.Config.Standbys,
+		Tty:              types.BoolValue(updatedMachine.Config.Init.Tty),
+		SwapSizeMb:       types.Int64Value(int64(updatedMachine.Config.Init.SwapSizeMb)),
+		KernelArgs:       updatedMachine.Config.Init.KernelArgs,
+		Dns:              DnsToTfDns(updatedMachine.Config.DNS, plan.Dns),
+		Containers:       ContainersToTfContainers(updatedMachine.Config.Containers),
+		RegionFallbacks:  plan.RegionFallbacks,
+		PlacedRegion:     types.StringValue(updatedMachine.Region),
+		HostDedicationId: optionalString(updatedMachine.Config.Guest.HostDedicationID),
+		PreferZone:       plan.PreferZone,
+		AvoidZone:        plan.AvoidZone,
+		Readiness:        plan.Readiness,
+		UpdateStrategy:   plan.UpdateStrategy,
+		AutoRollback:     plan.AutoRollback,
+		ForceDestroy:     plan.ForceDestroy,
+		Env:              env,
+		SecretEnv:        secretEnv,
+		IgnoreEnvKeys:    plan.IgnoreEnvKeys,
+		Services:         tfservices,
+		Mounts:           tfmounts,
 	}
 
 	resp.State.Set(ctx, state)
@@ -588,9 +1378,9 @@ func (mr flyMachineResource) Delete(ctx context.Context, req resource.DeleteRequ
 		resp.Diagnostics.AddError("fly wireguard tunnel must be open", err.Error())
 	}
 
-	machineApi := apiv1.NewMachineAPI(mr.httpClient, mr.httpEndpoint)
+	machineApi := apiv1.NewMachineAPI(&mr.httpClient, mr.httpEndpoint)
 
-	err = machineApi.DeleteMachine(data.App.ValueString(), data.Id.ValueString(), 50)
+	err = machineApi.DeleteMachine(ctx, data.App.ValueString(), data.Id.ValueString(), data.ForceDestroy.ValueBool())
 
 	if err != nil {
 		resp.Diagnostics.AddError("Machine delete failed", err.Error())
@@ -1,10 +1,18 @@
 package provider
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/fly-apps/terraform-provider-fly/pkg/apiv1"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/acctest"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	hreq "github.com/imroc/req/v3"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -335,3 +343,705 @@ resource "fly_machine" "testMachine" {
 }
 `, providerConfig(), getTestRegion(), app)
 }
+
+func TestAccFlyMachineStandbys(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceStandbysConfig(rName),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testStandby", "standbys.#", "1"),
+					resource.TestCheckResourceAttrPair("fly_machine.testStandby", "standbys.0", "fly_machine.testPrimary", "id"),
+				),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceStandbysConfig(name string) string {
+	app := os.Getenv("FLY_TF_TEST_APP")
+
+	return fmt.Sprintf(`
+%s
+
+resource "fly_machine" "testPrimary" {
+	app = "%s"
+	region = "%s"
+	name = "%s-primary"
+    image = "nginx"
+}
+
+resource "fly_machine" "testStandby" {
+	app = "%s"
+	region = "%s"
+	name = "%s-standby"
+    image = "nginx"
+	standbys = [fly_machine.testPrimary.id]
+}
+`, providerConfig(), app, getTestRegion(), name, app, getTestRegion(), name)
+}
+
+func TestAccFlyMachineGuestOptions(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceGuestOptionsConfig(rName, `{
+		skip_registration = true
+		nameservers = ["1.1.1.1"]
+	}`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "tty", "true"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "swap_size_mb", "512"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "dns.skip_registration", "true"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "dns.nameservers.0", "1.1.1.1"),
+				),
+			},
+			{
+				Config: testFlyMachineResourceGuestOptionsConfig(rName, "{ skip_registration = false }"),
+				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "dns.skip_registration", "false"),
+			},
+			{
+				Config: testFlyMachineResourceGuestOptionsConfig(rName, "{}"),
+				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "dns.skip_registration", "false"),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceGuestOptionsConfig(name string, dns string) string {
+	app := os.Getenv("FLY_TF_TEST_APP")
+
+	return fmt.Sprintf(`
+%s
+
+resource "fly_machine" "testMachine" {
+	app = "%s"
+	region = "%s"
+	name = "%s"
+    image = "nginx"
+	tty = true
+	swap_size_mb = 512
+	dns = %s
+}
+`, providerConfig(), app, getTestRegion(), name, dns)
+}
+
+func TestAccFlyMachineReplaceStrategy(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceUpdateStrategyConfig(rName, "nginx"),
+				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "update_strategy", "replace"),
+			},
+			{
+				Config: testFlyMachineResourceUpdateStrategyConfig(rName, "nginx:latest"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "image", "nginx:latest"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "auto_rollback", "true"),
+				),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceUpdateStrategyConfig(name string, image string) string {
+	app := os.Getenv("FLY_TF_TEST_APP")
+
+	return fmt.Sprintf(`
+%s
+
+resource "fly_machine" "testMachine" {
+	app = "%s"
+	region = "%s"
+	name = "%s"
+    image = "%s"
+	update_strategy = "replace"
+	auto_rollback = true
+}
+`, providerConfig(), app, getTestRegion(), name, image)
+}
+
+func TestAccFlyMachineRegionFallbacks(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceRegionFallbacksConfig(rName),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "region", getTestRegion()),
+					resource.TestCheckResourceAttrSet("fly_machine.testMachine", "placed_region"),
+				),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceRegionFallbacksConfig(name string) string {
+	app := os.Getenv("FLY_TF_TEST_APP")
+
+	return fmt.Sprintf(`
+%s
+
+resource "fly_machine" "testMachine" {
+	app = "%s"
+	region = "%s"
+	region_fallbacks = ["iad", "ord"]
+	name = "%s"
+    image = "nginx"
+}
+`, providerConfig(), app, getTestRegion(), name)
+}
+
+func TestAccFlyMachineReadiness(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceReadinessConfig(rName),
+				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "readiness.port", "80"),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceReadinessConfig(name string) string {
+	app := os.Getenv("FLY_TF_TEST_APP")
+
+	return fmt.Sprintf(`
+%s
+
+resource "fly_machine" "testMachine" {
+	app = "%s"
+	region = "%s"
+	name = "%s"
+    image = "nginx"
+	readiness = {
+		port = 80
+		path = "/"
+		timeout = "90s"
+	}
+}
+`, providerConfig(), app, getTestRegion(), name)
+}
+
+func TestAccFlyMachineSecretEnv(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceSecretEnvConfig(rName),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "env.%", "1"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "env.plainkey", "value"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "secret_env.secretkey", "secretvalue"),
+					resource.TestCheckNoResourceAttr("fly_machine.testMachine", "env.secretkey"),
+				),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceSecretEnvConfig(name string) string {
+	app := os.Getenv("FLY_TF_TEST_APP")
+
+	return fmt.Sprintf(`
+%s
+
+resource "fly_machine" "testMachine" {
+	app = "%s"
+	region = "%s"
+	name = "%s"
+    image = "nginx"
+	env = {
+		plainkey = "value"
+	}
+	secret_env = {
+		secretkey = "secretvalue"
+	}
+}
+`, providerConfig(), app, getTestRegion(), name)
+}
+
+func TestAccFlyMachineIgnoreEnvKeys(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceIgnoreEnvKeysConfig(rName),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "env.%", "1"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "env.key", "value"),
+				),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceIgnoreEnvKeysConfig(name string) string {
+	app := os.Getenv("FLY_TF_TEST_APP")
+
+	return fmt.Sprintf(`
+%s
+
+resource "fly_machine" "testMachine" {
+	app = "%s"
+	region = "%s"
+	name = "%s"
+    image = "nginx"
+	env = {
+		key = "value"
+	}
+	ignore_env_keys = ["FLY_*", "PRIMARY_REGION"]
+}
+`, providerConfig(), app, getTestRegion(), name)
+}
+
+func TestAccFlyMachineUpdateKeepsId(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	var machineId string
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceConfig(rName),
+				Check: resource.TestCheckResourceAttrWith("fly_machine.testMachine", "id", func(id string) error {
+					machineId = id
+					return nil
+				}),
+			},
+			{
+				Config: testFlyMachineResourceUpdateConfig(rName),
+				Check: resource.TestCheckResourceAttrWith("fly_machine.testMachine", "id", func(id string) error {
+					if id != machineId {
+						return fmt.Errorf("machine was replaced: id changed from %s to %s", machineId, id)
+					}
+					return nil
+				}),
+			},
+		},
+	})
+}
+
+func TestAccFlyMachineVolumeByName(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	volName := "vol_" + acctest.RandStringFromCharSet(8, "abcdefghijklmnopqrstuvwxyz")
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceVolumeByNameConfig(rName, volName),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "mounts.0.volume", volName),
+					resource.TestCheckResourceAttrPair("fly_machine.testMachine", "mounts.0.volume_id", "fly_volume.testVolume", "id"),
+				),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceVolumeByNameConfig(name string, volName string) string {
+	app := os.Getenv("FLY_TF_TEST_APP")
+
+	return fmt.Sprintf(`
+%s
+
+resource "fly_volume" "testVolume" {
+	app = "%s"
+	region = "%s"
+	name = "%s"
+	size = 1
+}
+
+resource "fly_machine" "testMachine" {
+	app = "%s"
+	region = "%s"
+	name = "%s"
+    image = "nginx"
+	mounts = [
+		{
+			path = "/data"
+			volume = "%s"
+		}
+	]
+	depends_on = [fly_volume.testVolume]
+}
+`, providerConfig(), app, getTestRegion(), volName, app, getTestRegion(), name, volName)
+}
+
+func TestAccFlyMachineForceDestroy(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceForceDestroyConfig(rName),
+				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "force_destroy", "true"),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceForceDestroyConfig(name string) string {
+	app := os.Getenv("FLY_TF_TEST_APP")
+
+	return fmt.Sprintf(`
+%s
+
+resource "fly_machine" "testMachine" {
+	app = "%s"
+	region = "%s"
+	name = "%s"
+    image = "nginx"
+	force_destroy = true
+}
+`, providerConfig(), app, getTestRegion(), name)
+}
+
+func TestAccFlyMachineContainers(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceContainersConfig(rName),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "containers.#", "2"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "containers.1.depends_on.0.name", "app"),
+				),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceContainersConfig(name string) string {
+	app := os.Getenv("FLY_TF_TEST_APP")
+
+	return fmt.Sprintf(`
+%s
+
+resource "fly_machine" "testMachine" {
+	app = "%s"
+	region = "%s"
+	name = "%s"
+	containers = [
+		{
+			name = "app"
+			image = "nginx"
+			healthchecks = [
+				{
+					http = {
+						port = 80
+						path = "/"
+					}
+				}
+			]
+		},
+		{
+			name = "sidecar"
+			image = "busybox"
+			cmd = ["sleep", "inf"]
+			depends_on = [
+				{
+					name = "app"
+					condition = "healthy"
+				}
+			]
+		}
+	]
+}
+`, providerConfig(), app, getTestRegion(), name)
+}
+
+func TestAccFlyMachinePublicEndpoint(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourcePublicEndpointConfig(rName),
+				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "name", rName),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourcePublicEndpointConfig(name string) string {
+	app := os.Getenv("FLY_TF_TEST_APP")
+
+	return fmt.Sprintf(`
+provider "fly" {
+  fly_http_endpoint = "https://api.machines.dev"
+}
+
+resource "fly_machine" "testMachine" {
+	app = "%s"
+	region = "%s"
+	name = "%s"
+    image = "nginx"
+}
+`, app, getTestRegion(), name)
+}
+
+func TestPlacementConfig(t *testing.T) {
+	if p := placementConfig(types.StringNull(), types.StringNull()); p != nil {
+		t.Errorf("expected no placement without zones, got %+v", p)
+	}
+
+	// The machines api doesn't report zones, so check what a create sends instead.
+	var created apiv1.MachineCreateOrUpdateRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&created); err != nil {
+			t.Errorf("decoding create request: %s", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"id": "m1"})
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		prefer types.String
+		avoid  types.String
+		want   apiv1.PlacementConfig
+	}{
+		{types.StringValue("a"), types.StringNull(), apiv1.PlacementConfig{PreferZone: "a"}},
+		{types.StringNull(), types.StringValue("b"), apiv1.PlacementConfig{AvoidZone: "b"}},
+		{types.StringValue("a"), types.StringValue("b"), apiv1.PlacementConfig{PreferZone: "a", AvoidZone: "b"}},
+	}
+	api := apiv1.NewMachineAPI(hreq.C(), server.URL)
+	for _, tt := range tests {
+		created = apiv1.MachineCreateOrUpdateRequest{}
+		req := apiv1.MachineCreateOrUpdateRequest{Placement: placementConfig(tt.prefer, tt.avoid)}
+		var res apiv1.MachineResponse
+		if err := api.CreateMachine(req, "app", &res); err != nil {
+			t.Fatal(err)
+		}
+		if created.Placement == nil || *created.Placement != tt.want {
+			t.Errorf("placement sent for prefer %s avoid %s: got %+v, want %+v", tt.prefer, tt.avoid, created.Placement, tt.want)
+		}
+	}
+}
+
+func testService(port int64, protocol string, ports ...int64) TfService {
+	s := TfService{InternalPort: types.Int64Value(port), Protocol: types.StringValue(protocol)}
+	for _, p := range ports {
+		s.Ports = append(s.Ports, TfPort{Port: types.Int64Value(p)})
+	}
+	return s
+}
+
+// serviceKeys lists services as internal_port/protocol:port,port for comparisons.
+func serviceKeys(services []TfService) []string {
+	var keys []string
+	for _, s := range services {
+		key := fmt.Sprintf("%d/%s:", s.InternalPort.ValueInt64(), s.Protocol.ValueString())
+		for _, p := range s.Ports {
+			key += fmt.Sprintf("%d,", p.Port.ValueInt64())
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestOrderServicesLike(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []TfService
+		prior    []TfService
+		want     []string
+	}{
+		{
+			name:     "no prior",
+			services: []TfService{testService(80, "tcp", 443, 80), testService(53, "udp", 53)},
+			want:     []string{"80/tcp:443,80,", "53/udp:53,"},
+		},
+		{
+			name:     "reordered",
+			services: []TfService{testService(53, "udp", 53), testService(80, "tcp", 443, 80)},
+			prior:    []TfService{testService(80, "tcp", 80, 443), testService(53, "udp", 53)},
+			want:     []string{"80/tcp:80,443,", "53/udp:53,"},
+		},
+		{
+			name:     "same port other protocol",
+			services: []TfService{testService(53, "tcp", 53), testService(53, "udp", 53)},
+			prior:    []TfService{testService(53, "udp", 53), testService(53, "tcp", 53)},
+			want:     []string{"53/udp:53,", "53/tcp:53,"},
+		},
+		{
+			name:     "missing from api",
+			services: []TfService{testService(53, "udp", 53)},
+			prior:    []TfService{testService(80, "tcp", 80), testService(53, "udp", 53)},
+			want:     []string{"53/udp:53,"},
+		},
+		{
+			name:     "extra from api",
+			services: []TfService{testService(8080, "tcp", 8080), testService(80, "tcp", 81, 80)},
+			prior:    []TfService{testService(80, "tcp", 80)},
+			want:     []string{"80/tcp:80,81,", "8080/tcp:8080,"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := serviceKeys(orderServicesLike(tt.services, tt.prior))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderPortsLikeKeepsHandlerOrder(t *testing.T) {
+	ports := []TfPort{{Port: types.Int64Value(443), Handlers: []types.String{types.StringValue("http"), types.StringValue("tls")}}}
+	prior := []TfPort{{Port: types.Int64Value(443), Handlers: []types.String{types.StringValue("tls"), types.StringValue("http")}}}
+	got := orderPortsLike(ports, prior)
+	if !reflect.DeepEqual(got[0].Handlers, prior[0].Handlers) {
+		t.Errorf("got handlers %v, want %v", got[0].Handlers, prior[0].Handlers)
+	}
+
+	prior[0].Handlers = []types.String{types.StringValue("tls")}
+	got = orderPortsLike(ports, prior)
+	if !reflect.DeepEqual(got[0].Handlers, ports[0].Handlers) {
+		t.Errorf("changed handlers were replaced by prior ones: %v", got[0].Handlers)
+	}
+}
+
+func testMount(path string, volume string) TfMachineMount {
+	return TfMachineMount{Path: types.StringValue(path), Volume: types.StringValue(volume), VolumeId: types.StringValue(volume)}
+}
+
+func mountPaths(mounts []TfMachineMount) []string {
+	var paths []string
+	for _, m := range mounts {
+		paths = append(paths, m.Path.ValueString())
+	}
+	return paths
+}
+
+func TestOrderMountsLike(t *testing.T) {
+	tests := []struct {
+		name   string
+		mounts []TfMachineMount
+		prior  []TfMachineMount
+		want   []string
+	}{
+		{
+			name:   "no prior",
+			mounts: []TfMachineMount{testMount("/b", "vol_b"), testMount("/a", "vol_a")},
+			want:   []string{"/b", "/a"},
+		},
+		{
+			name:   "reordered",
+			mounts: []TfMachineMount{testMount("/b", "vol_b"), testMount("/a", "vol_a")},
+			prior:  []TfMachineMount{testMount("/a", "vol_a"), testMount("/b", "vol_b")},
+			want:   []string{"/a", "/b"},
+		},
+		{
+			name:   "missing from api",
+			mounts: []TfMachineMount{testMount("/b", "vol_b")},
+			prior:  []TfMachineMount{testMount("/a", "vol_a"), testMount("/b", "vol_b")},
+			want:   []string{"/b"},
+		},
+		{
+			name:   "extra from api",
+			mounts: []TfMachineMount{testMount("/c", "vol_c"), testMount("/b", "vol_b")},
+			prior:  []TfMachineMount{testMount("/b", "vol_b")},
+			want:   []string{"/b", "/c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mountPaths(orderMountsLike(tt.mounts, tt.prior))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithoutIgnoredEnv(t *testing.T) {
+	machineEnv := map[string]string{"key": "value", "FLY_REGION": "ord", "FLY_TOKEN": "secret", "PRIMARY_REGION": "ord"}
+	envMap := func(keys ...string) types.Map {
+		values := map[string]attr.Value{}
+		for _, k := range keys {
+			values[k] = types.StringValue(machineEnv[k])
+		}
+		return types.MapValueMust(types.StringType, values)
+	}
+
+	tests := []struct {
+		name      string
+		patterns  []string
+		env       types.Map
+		secretEnv types.Map
+		want      map[string]string
+	}{
+		{
+			name:      "no patterns",
+			env:       envMap("key"),
+			secretEnv: types.MapNull(types.StringType),
+			want:      machineEnv,
+		},
+		{
+			name:      "ignored",
+			patterns:  []string{"FLY_*", "PRIMARY_REGION"},
+			env:       envMap("key"),
+			secretEnv: types.MapNull(types.StringType),
+			want:      map[string]string{"key": "value"},
+		},
+		{
+			name:      "configured in env",
+			patterns:  []string{"FLY_*"},
+			env:       envMap("key", "FLY_REGION"),
+			secretEnv: types.MapNull(types.StringType),
+			want:      map[string]string{"key": "value", "FLY_REGION": "ord", "PRIMARY_REGION": "ord"},
+		},
+		{
+			name:      "configured in secret_env",
+			patterns:  []string{"FLY_*"},
+			env:       envMap("key"),
+			secretEnv: envMap("FLY_TOKEN"),
+			want:      map[string]string{"key": "value", "FLY_TOKEN": "secret", "PRIMARY_REGION": "ord"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withoutIgnoredEnv(machineEnv, tt.patterns, tt.env, tt.secretEnv)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fly-apps/terraform-provider-fly/pkg/apiv1"
+	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+const (
+	updateStrategyInPlace        = "in_place"
+	updateStrategyStopThenUpdate = "stop_then_update"
+	updateStrategyReplace        = "replace"
+)
+
+var updateStrategies = []string{updateStrategyInPlace, updateStrategyStopThenUpdate, updateStrategyReplace}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checksTimeout is how long an updated machine's health checks get to pass before auto_rollback kicks in.
+const checksTimeout = 60 * time.Second
+
+// applyMachineUpdate updates machine id to updateReq using strategy, then waits for it to start and, if ready is
+// set, for it to pass its readiness probe. Machines destroyed along the way are forced with forceDestroy. With
+// autoRollback set, the previous config is restored if the machine
+// doesn't start, its checks fail or it never becomes ready. It returns the machine the state should be written
+// from, or nil if there is nothing to record.
+func applyMachineUpdate(ctx context.Context, machineApi *apiv1.MachineAPI, strategy string, autoRollback bool, forceDestroy bool, app string, id string, updateReq apiv1.MachineCreateOrUpdateRequest, ready func(machine *apiv1.MachineResponse) error, diags *diag.Diagnostics) *apiv1.MachineResponse {
+	var previous apiv1.MachineResponse
+	_, err := machineApi.ReadMachine(app, id, &previous)
+	if err != nil {
+		diags.AddError("Failed to read machine before update", err.Error())
+		return nil
+	}
+
+	var updated apiv1.MachineResponse
+	previousRemoved := false
+	switch strategy {
+	case updateStrategyReplace:
+		if len(updateReq.Config.Mounts) > 0 {
+			// A volume can only be attached to one machine at a time, so the old machine has to go first.
+			err = machineApi.DeleteMachine(ctx, app, id, forceDestroy)
+			if err != nil {
+				diags.AddError("Failed to destroy machine being replaced", err.Error())
+				return nil
+			}
+			previousRemoved = true
+		}
+		err = machineApi.CreateMachineIdempotent(ctx, updateReq, app, uuid.New().String(), createAttempts, &updated)
+		if err != nil {
+			diags.AddError("Failed to create replacement machine", err.Error())
+			if previousRemoved {
+				return nil
+			}
+			return &previous
+		}
+	case updateStrategyStopThenUpdate:
+		err = machineApi.StopMachine(ctx, app, id)
+		if err != nil {
+			diags.AddError("Failed to stop machine", err.Error())
+			return nil
+		}
+		err = machineApi.WaitForMachineState(app, id, previous.InstanceID, "stopped")
+		if err != nil {
+			diags.AddError("Failed waiting for machine to stop", err.Error())
+			return nil
+		}
+		fallthrough
+	default:
+		err = machineApi.UpdateMachine(updateReq, app, id, &updated)
+		if err != nil {
+			diags.AddError("Failed to update machine", err.Error())
+			return nil
+		}
+	}
+
+	if !autoRollback {
+		err = machineApi.WaitForMachine(app, updated.ID, updated.InstanceID)
+		if err != nil {
+			tflog.Info(ctx, "Waiting errored")
+			addWaitFailedWarning(machineApi, app, updated.ID, err, diags)
+		}
+		if ready != nil {
+			err = ready(&updated)
+			if err != nil {
+				diags.AddError("Machine did not become ready", err.Error())
+			}
+		}
+		if strategy == updateStrategyReplace && !previousRemoved {
+			destroyReplacedMachine(ctx, machineApi, app, id, forceDestroy, diags)
+		}
+		return &updated
+	}
+
+	verifyErr := verifyMachine(machineApi, app, updated.ID, updated.InstanceID)
+	if verifyErr == nil && ready != nil {
+		verifyErr = ready(&updated)
+	}
+	if verifyErr == nil {
+		if strategy == updateStrategyReplace && !previousRemoved {
+			destroyReplacedMachine(ctx, machineApi, app, id, forceDestroy, diags)
+		}
+		return &updated
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("machine %s failed verification, rolling back: %s", updated.ID, verifyErr))
+
+	if strategy == updateStrategyReplace {
+		if previousRemoved {
+			diags.AddError("Machine update failed and could not be rolled back", fmt.Sprintf("%s\n\nMachine %s was already destroyed to free its volumes.", verifyErr, id))
+			return &updated
+		}
+		err = machineApi.DeleteMachine(ctx, app, updated.ID, forceDestroy)
+		if err != nil {
+			diags.AddError("Machine update failed and could not be rolled back", fmt.Sprintf("%s\n\nDestroying replacement machine %s failed: %s", verifyErr, updated.ID, err))
+			return &updated
+		}
+		diags.AddError("Machine update rolled back", fmt.Sprintf("%s\n\nThe replacement machine was destroyed and %s was kept.", verifyErr, id))
+		return &previous
+	}
+
+	var restored apiv1.MachineResponse
+	err = rollbackMachine(machineApi, app, id, previous, &restored)
+	if err != nil {
+		diags.AddError("Machine update failed and could not be rolled back", fmt.Sprintf("%s\n\nRollback failed: %s", verifyErr, err))
+		return &updated
+	}
+	diags.AddError("Machine update rolled back", fmt.Sprintf("%s\n\nThe machine was restored to version %s.", verifyErr, previous.InstanceID))
+	return &restored
+}
+
+// verifyMachine waits for the machine to start and for all of its health checks to pass.
+func verifyMachine(machineApi *apiv1.MachineAPI, app string, id string, instanceID string) error {
+	err := machineApi.WaitForMachine(app, id, instanceID)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(checksTimeout)
+	for {
+		var machine apiv1.MachineResponse
+		_, err = machineApi.ReadMachine(app, id, &machine)
+		if err != nil {
+			return err
+		}
+		var failing []string
+		for _, c := range machine.Checks {
+			if c.Status != "passing" {
+				failing = append(failing, fmt.Sprintf("%s is %s: %s", c.Name, c.Status, c.Output))
+			}
+		}
+		if len(failing) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("health checks did not pass: " + strings.Join(failing, "; "))
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// rollbackMachine restores the config the machine ran as previous.InstanceID, taken from its version history.
+func rollbackMachine(machineApi *apiv1.MachineAPI, app string, id string, previous apiv1.MachineResponse, res *apiv1.MachineResponse) error {
+	versions, err := machineApi.ListMachineVersions(app, id)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if v.Version != previous.InstanceID {
+			continue
+		}
+		err = machineApi.UpdateMachine(apiv1.MachineCreateOrUpdateRequest{
+			Name:   previous.Name,
+			Region: previous.Region,
+			Config: v.UserConfig,
+		}, app, id, res)
+		if err != nil {
+			return err
+		}
+		// Best effort, the old config is what was running before so there is nothing better to fall back to.
+		_ = machineApi.WaitForMachine(app, id, res.InstanceID)
+		return nil
+	}
+	return fmt.Errorf("version %s not found in the machine's history", previous.InstanceID)
+}
+
+func destroyReplacedMachine(ctx context.Context, machineApi *apiv1.MachineAPI, app string, id string, force bool, diags *diag.Diagnostics) {
+	err := machineApi.DeleteMachine(ctx, app, id, force)
+	if err != nil {
+		diags.AddError("Failed to destroy replaced machine", fmt.Sprintf("Machine %s was replaced but could not be destroyed: %s", id, err))
+	}
+}
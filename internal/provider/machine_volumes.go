@@ -0,0 +1,123 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fly-apps/terraform-provider-fly/pkg/apiv1"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// resolveVolume finds the volume ref names in region, ref can also be the id of a volume in region. Volumes attached
+// to a machine other than machineID can't be mounted, machineID is empty for a machine that doesn't exist yet.
+func resolveVolume(volumes []apiv1.Volume, ref string, region string, machineID string) (string, error) {
+	var matches []apiv1.Volume
+	for _, v := range volumes {
+		if v.State == "destroyed" || v.State == "pending_destroy" {
+			continue
+		}
+		if v.ID == ref {
+			if v.Region != region {
+				return "", fmt.Errorf("volume %s is in %s, not %s", ref, v.Region, region)
+			}
+			matches = []apiv1.Volume{v}
+			break
+		}
+		if v.Name == ref && v.Region == region {
+			matches = append(matches, v)
+		}
+	}
+
+	// A name shared by several volumes is fine if one of them is already ours.
+	if len(matches) > 1 && machineID != "" {
+		for _, v := range matches {
+			if v.AttachedMachineID == machineID {
+				return v.ID, nil
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no volume named %s in %s", ref, region)
+	case 1:
+		v := matches[0]
+		if v.AttachedMachineID != "" && v.AttachedMachineID != machineID {
+			return "", fmt.Errorf("volume %s (%s) is already attached to machine %s", ref, v.ID, v.AttachedMachineID)
+		}
+		return v.ID, nil
+	default:
+		var ids []string
+		for _, v := range matches {
+			ids = append(ids, v.ID)
+		}
+		return "", fmt.Errorf("volume name %s is ambiguous in %s, use one of the ids: %s", ref, region, strings.Join(ids, ", "))
+	}
+}
+
+// resolveMounts sets volume_id on each mount to the id of the volume it names.
+func resolveMounts(machineAPI *apiv1.MachineAPI, app string, region string, machineID string, mounts []TfMachineMount) error {
+	if len(mounts) == 0 {
+		return nil
+	}
+	volumes, err := machineAPI.ListVolumes(app)
+	if err != nil {
+		return err
+	}
+	for i := range mounts {
+		id, err := resolveVolume(volumes, mounts[i].Volume.ValueString(), region, machineID)
+		if err != nil {
+			return err
+		}
+		mounts[i].VolumeId = types.StringValue(id)
+	}
+	return nil
+}
+
+// keepConfiguredVolumes puts back the volume names from prior, the api only knows volume ids. Mounts are expected
+// in the order of prior, see orderMountsLike.
+func keepConfiguredVolumes(mounts []TfMachineMount, prior []TfMachineMount) []TfMachineMount {
+	for i := range mounts {
+		for _, p := range prior {
+			if p.Path.Equal(mounts[i].Path) && (p.VolumeId.Equal(mounts[i].VolumeId) || p.Volume.Equal(mounts[i].VolumeId)) {
+				mounts[i].Volume = p.Volume
+				break
+			}
+		}
+	}
+	return mounts
+}
+
+// replacedMounts returns the indexes of the planned mounts that get a different volume than the prior mount at the
+// same path. A ref that is neither the prior volume's name nor its id is looked up with resolve, and one that can't
+// be looked up counts as a different volume. volume_id is planned for the mounts that keep their volume.
+func replacedMounts(planned []TfMachineMount, prior []TfMachineMount, resolve func(ref string) (string, error)) []int {
+	var replaced []int
+	for i := range planned {
+		m := &planned[i]
+		m.VolumeId = types.StringUnknown()
+
+		var p *TfMachineMount
+		for j := range prior {
+			if prior[j].Path.Equal(m.Path) {
+				p = &prior[j]
+				break
+			}
+		}
+		if p == nil || m.Volume.IsUnknown() {
+			replaced = append(replaced, i)
+			continue
+		}
+
+		id := p.VolumeId.ValueString()
+		if ref := m.Volume.ValueString(); ref != p.Volume.ValueString() && ref != id {
+			resolved, err := resolve(ref)
+			if err != nil || resolved != id {
+				replaced = append(replaced, i)
+				continue
+			}
+		}
+		m.VolumeId = p.VolumeId
+	}
+	return replaced
+}
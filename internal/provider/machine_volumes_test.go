@@ -0,0 +1,189 @@
+package provider
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/fly-apps/terraform-provider-fly/pkg/apiv1"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+func TestKeepConfiguredVolumes(t *testing.T) {
+	byName := TfMachineMount{Path: types.StringValue("/data"), Volume: types.StringValue("data"), VolumeId: types.StringValue("vol_1")}
+	byId := TfMachineMount{Path: types.StringValue("/logs"), Volume: types.StringValue("vol_2"), VolumeId: types.StringUnknown()}
+
+	tests := []struct {
+		name   string
+		mounts []TfMachineMount
+		prior  []TfMachineMount
+		want   []string
+	}{
+		{
+			name:   "names put back",
+			mounts: []TfMachineMount{testMount("/data", "vol_1"), testMount("/logs", "vol_2")},
+			prior:  []TfMachineMount{byName, byId},
+			want:   []string{"data", "vol_2"},
+		},
+		{
+			name:   "reordered",
+			mounts: []TfMachineMount{testMount("/logs", "vol_2"), testMount("/data", "vol_1")},
+			prior:  []TfMachineMount{byName, byId},
+			want:   []string{"vol_2", "data"},
+		},
+		{
+			name:   "volume changed outside terraform",
+			mounts: []TfMachineMount{testMount("/data", "vol_3")},
+			prior:  []TfMachineMount{byName},
+			want:   []string{"vol_3"},
+		},
+		{
+			name:   "missing from prior",
+			mounts: []TfMachineMount{testMount("/data", "vol_1"), testMount("/cache", "vol_4")},
+			prior:  []TfMachineMount{byName},
+			want:   []string{"data", "vol_4"},
+		},
+		{
+			name:   "missing from api",
+			mounts: []TfMachineMount{testMount("/logs", "vol_2")},
+			prior:  []TfMachineMount{byName, byId},
+			want:   []string{"vol_2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := keepConfiguredVolumes(tt.mounts, tt.prior)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d mounts, want %d", len(got), len(tt.want))
+			}
+			for i, m := range got {
+				if m.Volume.ValueString() != tt.want[i] {
+					t.Errorf("mount %s: got volume %s, want %s", m.Path.ValueString(), m.Volume.ValueString(), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReplacedMounts(t *testing.T) {
+	prior := []TfMachineMount{
+		{Path: types.StringValue("/data"), Volume: types.StringValue("data"), VolumeId: types.StringValue("vol_1")},
+		{Path: types.StringValue("/logs"), Volume: types.StringValue("vol_2"), VolumeId: types.StringValue("vol_2")},
+	}
+	planned := func(mounts ...[2]string) []TfMachineMount {
+		var tfmounts []TfMachineMount
+		for _, m := range mounts {
+			tfmounts = append(tfmounts, TfMachineMount{Path: types.StringValue(m[0]), Volume: types.StringValue(m[1]), VolumeId: types.StringUnknown()})
+		}
+		return tfmounts
+	}
+	volumes := map[string]string{"data": "vol_1", "logs": "vol_2", "other": "vol_3"}
+	resolve := func(ref string) (string, error) {
+		if id, ok := volumes[ref]; ok {
+			return id, nil
+		}
+		for _, id := range volumes {
+			if id == ref {
+				return id, nil
+			}
+		}
+		return "", errors.New("no volume named " + ref)
+	}
+
+	tests := []struct {
+		name     string
+		planned  []TfMachineMount
+		replaced []int
+		ids      []string
+	}{
+		{
+			name:    "unchanged",
+			planned: planned([2]string{"/data", "data"}, [2]string{"/logs", "vol_2"}),
+			ids:     []string{"vol_1", "vol_2"},
+		},
+		{
+			name:    "reordered",
+			planned: planned([2]string{"/logs", "vol_2"}, [2]string{"/data", "data"}),
+			ids:     []string{"vol_2", "vol_1"},
+		},
+		{
+			name:    "name and id swapped",
+			planned: planned([2]string{"/data", "vol_1"}, [2]string{"/logs", "logs"}),
+			ids:     []string{"vol_1", "vol_2"},
+		},
+		{
+			name:    "reordered and swapped",
+			planned: planned([2]string{"/logs", "logs"}, [2]string{"/data", "vol_1"}),
+			ids:     []string{"vol_2", "vol_1"},
+		},
+		{
+			name:     "different volume",
+			planned:  planned([2]string{"/data", "other"}, [2]string{"/logs", "vol_2"}),
+			replaced: []int{0},
+			ids:      []string{"", "vol_2"},
+		},
+		{
+			name:     "volumes moved between paths",
+			planned:  planned([2]string{"/data", "vol_2"}, [2]string{"/logs", "data"}),
+			replaced: []int{0, 1},
+			ids:      []string{"", ""},
+		},
+		{
+			name:     "new path",
+			planned:  planned([2]string{"/cache", "data"}, [2]string{"/logs", "vol_2"}),
+			replaced: []int{0},
+			ids:      []string{"", "vol_2"},
+		},
+		{
+			name:     "unknown volume",
+			planned:  planned([2]string{"/data", "missing"}, [2]string{"/logs", "vol_2"}),
+			replaced: []int{0},
+			ids:      []string{"", "vol_2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replaced := replacedMounts(tt.planned, prior, resolve)
+			if !reflect.DeepEqual(replaced, tt.replaced) {
+				t.Errorf("got replaced mounts %v, want %v", replaced, tt.replaced)
+			}
+			for i, m := range tt.planned {
+				if tt.ids[i] == "" {
+					if !m.VolumeId.IsUnknown() {
+						t.Errorf("mount %s: got volume_id %s, want unknown", m.Path.ValueString(), m.VolumeId.ValueString())
+					}
+				} else if m.VolumeId.ValueString() != tt.ids[i] {
+					t.Errorf("mount %s: got volume_id %s, want %s", m.Path.ValueString(), m.VolumeId.ValueString(), tt.ids[i])
+				}
+			}
+		})
+	}
+}
+
+func TestResolveVolume(t *testing.T) {
+	volumes := []apiv1.Volume{
+		{ID: "vol_1", Name: "data", Region: "ord"},
+		{ID: "vol_2", Name: "data", Region: "fra"},
+	}
+	tests := []struct {
+		ref    string
+		region string
+		want   string
+	}{
+		{"data", "ord", "vol_1"},
+		{"data", "fra", "vol_2"},
+		{"vol_1", "ord", "vol_1"},
+		{"vol_1", "fra", ""},
+		{"data", "syd", ""},
+	}
+	for _, tt := range tests {
+		got, err := resolveVolume(volumes, tt.ref, tt.region, "")
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s in %s: got %s, want an error", tt.ref, tt.region, got)
+			}
+		} else if got != tt.want || err != nil {
+			t.Errorf("%s in %s: got %s, %v, want %s", tt.ref, tt.region, got, err, tt.want)
+		}
+	}
+}
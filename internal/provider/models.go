@@ -35,3 +35,6 @@ type ipDataSource struct {
 type volumeDataSource struct {
 	flyDataSource
 }
+type machineEventsDataSource struct {
+	flyDataSource
+}
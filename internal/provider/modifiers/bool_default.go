@@ -0,0 +1,43 @@
+package modifiers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// boolDefaultModifier is a plan modifier that sets a default value for a
+// types.BoolType attribute when it is not configured. The attribute must be
+// marked as Optional and Computed. When setting the state during the resource
+// Create, Read, or Update methods, this default value must also be included or
+// the Terraform CLI will generate an error.
+type boolDefaultModifier struct {
+	Default bool
+}
+
+// Description returns a plain text description of the validator's behavior, suitable for a practitioner to understand its impact.
+func (m boolDefaultModifier) Description(ctx context.Context) string {
+	return fmt.Sprintf("If value is not configured, defaults to %t", m.Default)
+}
+
+// MarkdownDescription returns a markdown formatted description of the validator's behavior, suitable for a practitioner to understand its impact.
+func (m boolDefaultModifier) MarkdownDescription(ctx context.Context) string {
+	return fmt.Sprintf("If value is not configured, defaults to `%t`", m.Default)
+}
+
+// PlanModifyBool runs the logic of the plan modifier.
+func (m boolDefaultModifier) PlanModifyBool(ctx context.Context, req planmodifier.BoolRequest, resp *planmodifier.BoolResponse) {
+	if !req.ConfigValue.IsNull() {
+		return
+	}
+
+	resp.PlanValue = types.BoolValue(m.Default)
+}
+
+func BoolDefault(defaultValue bool) boolDefaultModifier {
+	return boolDefaultModifier{
+		Default: defaultValue,
+	}
+}
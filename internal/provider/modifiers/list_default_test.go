@@ -0,0 +1,57 @@
+package modifiers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+func TestListDefault(t *testing.T) {
+	empty := types.ListValueMust(types.StringType, []attr.Value{})
+	configured := types.ListValueMust(types.StringType, []attr.Value{types.StringValue("FLY_*")})
+
+	tests := []struct {
+		name   string
+		config types.List
+		plan   types.List
+		want   types.List
+	}{
+		{
+			name:   "not configured",
+			config: types.ListNull(types.StringType),
+			plan:   types.ListUnknown(types.StringType),
+			want:   empty,
+		},
+		{
+			name:   "configured",
+			config: configured,
+			plan:   configured,
+			want:   configured,
+		},
+		{
+			name:   "configured empty",
+			config: empty,
+			plan:   empty,
+			want:   empty,
+		},
+		{
+			name:   "not known yet",
+			config: types.ListUnknown(types.StringType),
+			plan:   types.ListUnknown(types.StringType),
+			want:   types.ListUnknown(types.StringType),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := planmodifier.ListRequest{ConfigValue: tt.config, PlanValue: tt.plan}
+			resp := &planmodifier.ListResponse{PlanValue: tt.plan}
+			ListDefault(empty).PlanModifyList(context.Background(), req, resp)
+			if !resp.PlanValue.Equal(tt.want) {
+				t.Errorf("got %s, want %s", resp.PlanValue, tt.want)
+			}
+		})
+	}
+}
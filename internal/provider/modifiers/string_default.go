@@ -5,13 +5,13 @@ import (
 	"fmt"
 
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
-	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 )
 
 // stringDefaultModifier is a plan modifier that sets a default value for a
 // types.StringType attribute when it is not configured. The attribute must be
-// marked as Optional and Computed. When setting the state during the resource
+// marked as Optional and Computed, attributes that are only Computed are left
+// unknown for the server to fill in. When setting the state during the resource
 // Create, Read, or Update methods, this default value must also be included or
 // the Terraform CLI will generate an error.
 type stringDefaultModifier struct {
@@ -33,18 +33,9 @@ func (m stringDefaultModifier) MarkdownDescription(ctx context.Context) string {
 // `resp` contains fields for updating the planned value, triggering resource
 // replacement, and returning diagnostics.
 func (m stringDefaultModifier) PlanModifyString(ctx context.Context, req planmodifier.StringRequest, resp *planmodifier.StringResponse) {
-	// types.String must be the attr.Value produced by the attr.Type in the schema for this attribute
-	// for generic plan modifiers, use
-	// https://pkg.go.dev/github.com/hashicorp/terraform-plugin-framework/tfsdk#ConvertValue
-	// to convert into a known type.
-	var str types.String
-	diags := tfsdk.ValueAs(ctx, req.PlanValue, &str)
-	resp.Diagnostics.Append(diags...)
-	if diags.HasError() {
-		return
-	}
-
-	if !str.IsNull() {
+	// Unset computed attributes are already planned as unknown by the time plan modifiers run,
+	// so whether a value was configured has to be decided from the config.
+	if !req.ConfigValue.IsNull() {
 		return
 	}
 
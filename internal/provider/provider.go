@@ -2,19 +2,29 @@ package provider
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Khan/genqlient/graphql"
 	providerGraphql "github.com/fly-apps/terraform-provider-fly/graphql"
 	"github.com/fly-apps/terraform-provider-fly/internal/utils"
 	"github.com/fly-apps/terraform-provider-fly/internal/wg"
+	"github.com/fly-apps/terraform-provider-fly/pkg/apiv1"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
 	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/provider/schema"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
 	hreq "github.com/imroc/req/v3"
+	"golang.zx2c4.com/wireguard/device"
 
 	"github.com/hashicorp/terraform-plugin-framework/diag"
 	tfsdkprovider "github.com/hashicorp/terraform-plugin-framework/provider"
@@ -34,6 +44,9 @@ type providerClients struct {
 	httpEndpoint string
 	gqlClient    gqlClient
 	httpClient   hreq.Client
+	tunnel       *wg.Tunnel
+
+	ignoreEnvKeys []string
 }
 
 func (c *providerClients) configure(providerData any, diags *diag.Diagnostics) {
@@ -51,12 +64,192 @@ func (c *providerClients) configure(providerData any, diags *diag.Diagnostics) {
 	}
 }
 
+func (c providerClients) ValidateOpenTunnel() (bool, error) {
+	_, err := c.httpClient.R().Get(c.httpEndpoint)
+	if err != nil {
+		return false, errors.New("can't connect to the api, is the tunnel open? :)")
+	}
+	return true, nil
+}
+
 type providerData struct {
 	FlyToken             types.String `tfsdk:"fly_api_token"`
 	FlyHttpEndpoint      types.String `tfsdk:"fly_http_endpoint"`
 	UseInternalTunnel    types.Bool   `tfsdk:"useinternaltunnel"`
 	InternalTunnelOrg    types.String `tfsdk:"internaltunnelorg"`
 	InternalTunnelRegion types.String `tfsdk:"internaltunnelregion"`
+	IgnoreEnvKeys        types.List   `tfsdk:"ignore_env_keys"`
+	MaxRetries           types.Int64  `tfsdk:"max_retries"`
+	RetryMaxWait         types.String `tfsdk:"retry_max_wait"`
+	GraphqlTimeout       types.String `tfsdk:"graphql_timeout"`
+	MachinesTimeout      types.String `tfsdk:"machines_timeout"`
+	FlyApiEndpoint       types.String `tfsdk:"fly_api_endpoint"`
+	CaBundle             types.String `tfsdk:"ca_bundle"`
+	TunnelGcMaxAge       types.String `tfsdk:"tunnel_gc_max_age"`
+	TunnelPeerCache      types.Bool   `tfsdk:"tunnel_peer_cache"`
+	TunnelPeerCachePath  types.String `tfsdk:"tunnel_peer_cache_path"`
+	TunnelMtu            types.Int64  `tfsdk:"internaltunnel_mtu"`
+	TunnelKeepAlive      types.Int64  `tfsdk:"internaltunnel_keepalive"`
+	TunnelLogLevel       types.String `tfsdk:"internaltunnel_log_level"`
+	TunnelTransport      types.String `tfsdk:"internaltunnel_transport"`
+	TunnelConfig         types.String `tfsdk:"internaltunnel_config"`
+	TunnelConfigFile     types.String `tfsdk:"internaltunnel_config_file"`
+	WireguardToken       types.String `tfsdk:"internaltunnel_wireguard_token"`
+}
+
+var tunnelLogLevels = map[string]int{
+	"silent":  device.LogLevelSilent,
+	"error":   device.LogLevelError,
+	"verbose": device.LogLevelVerbose,
+}
+
+// tunnelOptions returns the device settings of the internal tunnel.
+func (data providerData) tunnelOptions(diags *diag.Diagnostics) wg.Options {
+	var opts wg.Options
+	if !data.TunnelMtu.IsNull() {
+		opts.MTU = int(data.TunnelMtu.ValueInt64())
+	}
+	if !data.TunnelKeepAlive.IsNull() {
+		opts.KeepAlive = int(data.TunnelKeepAlive.ValueInt64())
+		if opts.KeepAlive == 0 {
+			opts.KeepAlive = -1
+		}
+	}
+	if !data.TunnelLogLevel.IsNull() {
+		level, ok := tunnelLogLevels[data.TunnelLogLevel.ValueString()]
+		if !ok {
+			diags.AddAttributeError(path.Root("internaltunnel_log_level"), "Invalid internaltunnel_log_level", fmt.Sprintf("internaltunnel_log_level must be one of silent, error or verbose, got %q", data.TunnelLogLevel.ValueString()))
+		}
+		opts.LogLevel = level
+	}
+	if !data.TunnelTransport.IsNull() {
+		opts.Transport = data.TunnelTransport.ValueString()
+		switch opts.Transport {
+		case wg.TransportUDP, wg.TransportWebSocket, wg.TransportAuto:
+		default:
+			diags.AddAttributeError(path.Root("internaltunnel_transport"), "Invalid internaltunnel_transport", fmt.Sprintf("internaltunnel_transport must be one of udp, websocket or auto, got %q", opts.Transport))
+		}
+	}
+	return opts
+}
+
+// tunnelSettings lists the internaltunnel_* attributes that are set, they only matter when the tunnel is used.
+func (data providerData) tunnelSettings() []string {
+	settings := []struct {
+		name  string
+		value attr.Value
+	}{
+		{"internaltunnel_config", data.TunnelConfig},
+		{"internaltunnel_config_file", data.TunnelConfigFile},
+		{"internaltunnel_wireguard_token", data.WireguardToken},
+		{"internaltunnel_mtu", data.TunnelMtu},
+		{"internaltunnel_keepalive", data.TunnelKeepAlive},
+		{"internaltunnel_transport", data.TunnelTransport},
+		{"internaltunnel_log_level", data.TunnelLogLevel},
+	}
+	var set []string
+	for _, s := range settings {
+		if !s.value.IsNull() {
+			set = append(set, s.name)
+		}
+	}
+	return set
+}
+
+// openTunnels holds the tunnels opened by Configure, Shutdown takes them down when the provider process stops.
+var openTunnels struct {
+	sync.Mutex
+	tunnels []*wg.Tunnel
+}
+
+// Shutdown takes down the tunnels the provider opened, removing their peers from the org. There is no terraform
+// request to report to at this point, failures are logged.
+func Shutdown() {
+	openTunnels.Lock()
+	defer openTunnels.Unlock()
+	// In parallel, the process is killed shortly after it is asked to stop. Down logs its own failures.
+	var done sync.WaitGroup
+	for _, tunnel := range openTunnels.tunnels {
+		done.Add(1)
+		go func(tunnel *wg.Tunnel) {
+			defer done.Done()
+			_ = tunnel.Down()
+		}(tunnel)
+	}
+	done.Wait()
+	openTunnels.tunnels = nil
+}
+
+const defaultApiEndpoint = "https://api.fly.io"
+
+// graphqlURL returns the graphql api of the fly api at endpoint, which can be given with or without the path.
+func graphqlURL(endpoint string) string {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if strings.HasSuffix(endpoint, "/graphql") {
+		return endpoint
+	}
+	return endpoint + "/graphql"
+}
+
+// certPool returns the system roots plus the certificates in bundle, either pem or the path of a pem file.
+func certPool(bundle string) (*x509.CertPool, error) {
+	pem := []byte(bundle)
+	if !strings.Contains(bundle, "-----BEGIN") {
+		var err error
+		pem, err = os.ReadFile(bundle)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in ca_bundle")
+	}
+	return pool, nil
+}
+
+// autoHttpEndpoint as fly_http_endpoint uses the public machines api, or the tunnel when that is unreachable.
+const autoHttpEndpoint = "auto"
+
+// publicEndpointReachable reports whether the public machines api answers at all, whatever the status.
+func publicEndpointReachable(ctx context.Context, client *hreq.Client) bool {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, err := client.R().SetContext(ctx).Get(apiv1.PublicEndpoint)
+	return err == nil
+}
+
+const (
+	defaultGraphqlTimeout  = 60 * time.Second
+	defaultMachinesTimeout = 2 * time.Minute
+)
+
+// stringSetting returns the value set on an attribute, falling back to the env variable env.
+func stringSetting(value types.String, env string) string {
+	if !value.IsNull() && !value.IsUnknown() {
+		return value.ValueString()
+	}
+	return os.Getenv(env)
+}
+
+// durationSetting parses the duration set on attribute, falling back to the env variable env and then to def.
+func durationSetting(value types.String, attribute string, env string, def time.Duration, diags *diag.Diagnostics) time.Duration {
+	setting := os.Getenv(env)
+	if !value.IsNull() && !value.IsUnknown() {
+		setting = value.ValueString()
+	}
+	if setting == "" {
+		return def
+	}
+	d, err := time.ParseDuration(setting)
+	if err != nil {
+		diags.AddAttributeError(path.Root(attribute), "Invalid "+attribute, err.Error())
+		return def
+	}
+	return d
 }
 
 func (p *provider) Configure(ctx context.Context, req tfsdkprovider.ConfigureRequest, resp *tfsdkprovider.ConfigureResponse) {
@@ -99,8 +292,87 @@ func (p *provider) Configure(ctx context.Context, req tfsdkprovider.ConfigureReq
 		httpEndpoint = endpoint
 	}
 
+	// A full url is used as is, even with the tunnel open, bare host:port endpoints are what the tunnel replaces.
+	fullURL := strings.Contains(httpEndpoint, "://")
+	autoEndpoint := httpEndpoint == autoHttpEndpoint
+
 	var clients providerClients
-	clients.httpEndpoint = httpEndpoint
+	clients.httpEndpoint = apiv1.EndpointURL(httpEndpoint)
+
+	if !data.IgnoreEnvKeys.IsNull() && !data.IgnoreEnvKeys.IsUnknown() {
+		resp.Diagnostics.Append(data.IgnoreEnvKeys.ElementsAs(ctx, &clients.ignoreEnvKeys, false)...)
+	}
+
+	maxRetries := utils.DefaultMaxRetries
+	if !data.MaxRetries.IsNull() && !data.MaxRetries.IsUnknown() {
+		maxRetries = int(data.MaxRetries.ValueInt64())
+	}
+	retryMaxWait := durationSetting(data.RetryMaxWait, "retry_max_wait", "FLY_RETRY_MAX_WAIT", utils.DefaultRetryMaxWait, &resp.Diagnostics)
+	graphqlTimeout := durationSetting(data.GraphqlTimeout, "graphql_timeout", "FLY_GRAPHQL_TIMEOUT", defaultGraphqlTimeout, &resp.Diagnostics)
+	machinesTimeout := durationSetting(data.MachinesTimeout, "machines_timeout", "FLY_MACHINES_TIMEOUT", defaultMachinesTimeout, &resp.Diagnostics)
+	var tunnelGcMaxAge time.Duration
+	if !data.TunnelGcMaxAge.IsNull() && !data.TunnelGcMaxAge.IsUnknown() {
+		tunnelGcMaxAge = durationSetting(data.TunnelGcMaxAge, "tunnel_gc_max_age", "", 0, &resp.Diagnostics)
+	}
+	tunnelOptions := data.tunnelOptions(&resp.Diagnostics)
+	var tunnelConfig *wg.Config
+	config := stringSetting(data.TunnelConfig, "FLY_WIREGUARD_CONFIG")
+	configFile := stringSetting(data.TunnelConfigFile, "FLY_WIREGUARD_CONFIG_FILE")
+	wireguardToken := stringSetting(data.WireguardToken, "FLY_WIREGUARD_TOKEN")
+	settings := 0
+	for _, s := range []string{config, configFile, wireguardToken} {
+		if s != "" {
+			settings++
+		}
+	}
+	if settings > 1 {
+		resp.Diagnostics.AddError("Conflicting tunnel settings", "Only one of internaltunnel_config, internaltunnel_config_file or internaltunnel_wireguard_token can be set")
+	} else if config != "" {
+		var err error
+		tunnelConfig, err = wg.ParseConfig(config)
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("internaltunnel_config"), "Invalid internaltunnel_config", err.Error())
+		}
+	} else if configFile != "" {
+		var err error
+		tunnelConfig, err = wg.LoadConfigFile(configFile)
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("internaltunnel_config_file"), "Invalid internaltunnel_config_file", err.Error())
+		}
+	}
+	var peerCache *wg.PeerCache
+	if data.TunnelPeerCache.ValueBool() || (!data.TunnelPeerCachePath.IsNull() && !data.TunnelPeerCachePath.IsUnknown()) {
+		cachePath := data.TunnelPeerCachePath.ValueString()
+		if cachePath == "" {
+			var err error
+			cachePath, err = wg.DefaultPeerCachePath()
+			if err != nil {
+				resp.Diagnostics.AddAttributeError(path.Root("tunnel_peer_cache_path"), "No default peer cache path", err.Error())
+			}
+		}
+		peerCache = &wg.PeerCache{Path: cachePath}
+	}
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	apiEndpoint := defaultApiEndpoint
+	if !data.FlyApiEndpoint.IsNull() && !data.FlyApiEndpoint.IsUnknown() {
+		apiEndpoint = data.FlyApiEndpoint.ValueString()
+	} else if endpoint, ok := os.LookupEnv("FLY_API_ENDPOINT"); ok && endpoint != "" {
+		apiEndpoint = endpoint
+	}
+
+	var tlsConfig *tls.Config
+	if !data.CaBundle.IsNull() && !data.CaBundle.IsUnknown() && data.CaBundle.ValueString() != "" {
+		pool, err := certPool(data.CaBundle.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("ca_bundle"), "Invalid ca_bundle", err.Error())
+			return
+		}
+		tlsConfig = &tls.Config{RootCAs: pool}
+	}
+	tunnelOptions.TLSConfig = tlsConfig
 
 	enableTracing := false
 	_, ok := os.LookupEnv("DEBUG")
@@ -117,26 +389,99 @@ func (p *provider) Configure(ctx context.Context, req tfsdkprovider.ConfigureReq
 	}
 
 	clients.httpClient.SetCommonHeader("Authorization", "Bearer "+p.token)
-	clients.httpClient.SetTimeout(2 * time.Minute)
+	if tlsConfig != nil {
+		clients.httpClient.SetTLSClientConfig(tlsConfig)
+	}
+	clients.httpClient.SetTimeout(machinesTimeout)
+	clients.httpClient.GetTransport().WrapRoundTrip(func(rt http.RoundTripper) http.RoundTripper {
+		return &utils.RetryTransport{UnderlyingTransport: rt, MaxRetries: maxRetries, MaxWait: retryMaxWait}
+	})
 
-	// TODO: Make timeout configurable
-	h := http.Client{Timeout: 60 * time.Second, Transport: &utils.Transport{UnderlyingTransport: http.DefaultTransport, Token: token, Ctx: ctx, EnableDebugTrace: enableTracing}}
-	client := graphql.NewClient("https://api.fly.io/graphql", &h)
+	var gqlTransport http.RoundTripper = http.DefaultTransport
+	if tlsConfig != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig
+		gqlTransport = t
+	}
+	h := http.Client{Timeout: graphqlTimeout, Transport: &utils.Transport{UnderlyingTransport: &utils.RetryTransport{UnderlyingTransport: gqlTransport, MaxRetries: maxRetries, MaxWait: retryMaxWait}, Token: token, Ctx: ctx, EnableDebugTrace: enableTracing}}
+	client := graphql.NewClient(graphqlURL(apiEndpoint), &h)
 	clients.gqlClient = *(*gqlClient)(&client)
 
-	if data.UseInternalTunnel.ValueBool() {
-		org, err := providerGraphql.Organization(context.Background(), client, data.InternalTunnelOrg.ValueString())
-		if err != nil {
-			resp.Diagnostics.AddError("Could not resolve organization", err.Error())
-			return
+	useTunnel := data.UseInternalTunnel.ValueBool()
+	if autoEndpoint {
+		if publicEndpointReachable(ctx, &clients.httpClient) {
+			clients.httpEndpoint = apiv1.PublicEndpoint
+			fullURL = true
+		} else {
+			tflog.Info(ctx, fmt.Sprintf("%s is unreachable, falling back to the internal tunnel", apiv1.PublicEndpoint))
+			useTunnel = true
+		}
+	}
+
+	if set := data.tunnelSettings(); !useTunnel && !autoEndpoint && len(set) > 0 {
+		resp.Diagnostics.AddWarning("Tunnel settings ignored", fmt.Sprintf("useinternaltunnel is off, so %s have no effect", strings.Join(set, ", ")))
+	}
+
+	if useTunnel {
+		if (tunnelConfig != nil || wireguardToken != "") && (peerCache != nil || tunnelGcMaxAge > 0) {
+			resp.Diagnostics.AddWarning("Tunnel peer settings ignored", "tunnel_peer_cache and tunnel_gc_max_age only apply to tunnels whose peer is registered with the api token")
+		}
+		var tunnel *wg.Tunnel
+		var err error
+		switch {
+		case tunnelConfig != nil:
+			tunnel, err = wg.EstablishConfig(ctx, tunnelConfig, tunnelOptions)
+		case wireguardToken != "":
+			peers := wg.DelegatedPeers{
+				Endpoint: apiEndpoint,
+				Token:    wireguardToken,
+				Client:   &http.Client{Timeout: graphqlTimeout, Transport: &utils.RetryTransport{UnderlyingTransport: gqlTransport, MaxRetries: maxRetries, MaxWait: retryMaxWait}},
+			}
+			tunnel, err = wg.EstablishDelegated(ctx, data.InternalTunnelRegion.ValueString(), peers, tunnelOptions)
+		default:
+			org, orgErr := providerGraphql.Organization(context.Background(), client, data.InternalTunnelOrg.ValueString())
+			if orgErr != nil {
+				resp.Diagnostics.AddError("Could not resolve organization", orgErr.Error())
+				return
+			}
+			if tunnelGcMaxAge > 0 {
+				var keep []string
+				if peerCache != nil {
+					keep, err = peerCache.Names()
+					if err != nil {
+						resp.Diagnostics.AddError("Failed to read tunnel peer cache", err.Error())
+						return
+					}
+				}
+				removed, errs := wg.CollectStalePeers(ctx, org.Organization.Id, tunnelGcMaxAge, keep, &client)
+				tflog.Info(ctx, fmt.Sprintf("removed %d stale wireguard peers", len(removed)))
+				for _, err := range errs {
+					resp.Diagnostics.AddWarning("Failed to remove stale wireguard peer", err.Error())
+				}
+			}
+			if peerCache != nil {
+				tunnel, err = wg.EstablishCached(ctx, org.Organization.Id, data.InternalTunnelRegion.ValueString(), token, &client, *peerCache, tunnelOptions)
+				if err != nil && tunnel != nil {
+					resp.Diagnostics.AddWarning("Failed to cache tunnel peer", err.Error())
+					err = nil
+				}
+			} else {
+				tunnel, err = wg.Establish(ctx, org.Organization.Id, data.InternalTunnelRegion.ValueString(), token, &client, tunnelOptions)
+			}
 		}
-		tunnel, err := wg.Establish(ctx, org.Organization.Id, data.InternalTunnelRegion.ValueString(), token, &client)
 		if err != nil {
 			resp.Diagnostics.AddError("failed to open internal tunnel", err.Error())
 			return
 		}
-		clients.httpClient.SetDial(tunnel.NetStack().DialContext)
-		clients.httpEndpoint = "_api.internal:4280"
+		openTunnels.Lock()
+		openTunnels.tunnels = append(openTunnels.tunnels, tunnel)
+		openTunnels.Unlock()
+		tunnel.Supervise(ctx)
+		clients.tunnel = tunnel
+		if !fullURL {
+			clients.httpClient.SetDial(tunnel.DialContext)
+			clients.httpEndpoint = apiv1.EndpointURL("_api.internal:4280")
+		}
 	}
 
 	resp.ResourceData = &clients
@@ -158,6 +503,7 @@ func (p *provider) DataSources(ctx context.Context) []func() datasource.DataSour
 		newAppDataSource,
 		newCertDataSource,
 		newIpDataSource,
+		newMachineEventsDataSource,
 	}
 }
 func (p *provider) Metadata(_ context.Context, _ tfsdkprovider.MetadataRequest, rep *tfsdkprovider.MetadataResponse) {
@@ -173,7 +519,7 @@ func (p *provider) Schema(ctx context.Context, _ tfsdkprovider.SchemaRequest, re
 				Optional:            true,
 			},
 			"fly_http_endpoint": schema.StringAttribute{
-				MarkdownDescription: "Where the clients should look to find the fly http endpoint",
+				MarkdownDescription: "Where the clients should look to find the fly machines api. Either a host:port served over plain http, like `fly proxy` does, or a full url such as `https://api.machines.dev`. `auto` uses the public api and falls back to the internal tunnel when it is unreachable. If not set checks env for FLY_HTTP_ENDPOINT, defaults to `127.0.0.1:4280`",
 				Optional:            true,
 			},
 			"useinternaltunnel": schema.BoolAttribute{
@@ -185,6 +531,77 @@ func (p *provider) Schema(ctx context.Context, _ tfsdkprovider.SchemaRequest, re
 			"internaltunnelregion": schema.StringAttribute{
 				Optional: true,
 			},
+			"ignore_env_keys": schema.ListAttribute{
+				MarkdownDescription: "Machine env keys managed outside terraform, like `FLY_PROCESS_GROUP`. A trailing `*` matches any key with that prefix",
+				Optional:            true,
+				ElementType:         types.StringType,
+			},
+			"max_retries": schema.Int64Attribute{
+				MarkdownDescription: "How many times a failed api request that is safe to repeat is retried, 3 if not set",
+				Optional:            true,
+			},
+			"retry_max_wait": schema.StringAttribute{
+				MarkdownDescription: "Longest wait between retries, as a duration like `30s`. Retry-After from the api is honored up to this long. If not set checks env for FLY_RETRY_MAX_WAIT",
+				Optional:            true,
+			},
+			"fly_api_endpoint": schema.StringAttribute{
+				MarkdownDescription: "Base url of the fly graphql api. If not set checks env for FLY_API_ENDPOINT, defaults to `https://api.fly.io`",
+				Optional:            true,
+			},
+			"ca_bundle": schema.StringAttribute{
+				MarkdownDescription: "PEM encoded certificates, or the path of a file holding them, trusted in addition to the system roots by both the graphql and machines api clients",
+				Optional:            true,
+			},
+			"internaltunnel_mtu": schema.Int64Attribute{
+				MarkdownDescription: "MTU of the internal tunnel, defaults to 1420",
+				Optional:            true,
+			},
+			"internaltunnel_keepalive": schema.Int64Attribute{
+				MarkdownDescription: "Seconds between keepalive packets of the internal tunnel, which keep it working behind nat while idle. Defaults to 25, 0 turns them off",
+				Optional:            true,
+			},
+			"internaltunnel_log_level": schema.StringAttribute{
+				MarkdownDescription: "Log level of the internal tunnel's wireguard device, one of `silent`, `error` or `verbose`. Logs go to the terraform log, see `TF_LOG`. Defaults to `silent`",
+				Optional:            true,
+			},
+			"internaltunnel_config": schema.StringAttribute{
+				MarkdownDescription: "A wg-quick style config, like `fly wireguard create` writes, to open the internal tunnel with instead of registering a peer with the api token. The peer is left registered. Can also be set with `FLY_WIREGUARD_CONFIG`",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"internaltunnel_config_file": schema.StringAttribute{
+				MarkdownDescription: "Path of a file holding the config of `internaltunnel_config`. Can also be set with `FLY_WIREGUARD_CONFIG_FILE`",
+				Optional:            true,
+			},
+			"internaltunnel_wireguard_token": schema.StringAttribute{
+				MarkdownDescription: "A delegated wireguard token, from `fly wireguard token create`, to register the internal tunnel's peer with instead of the api token, which then only needs access to the machines it manages. Can also be set with `FLY_WIREGUARD_TOKEN`",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"internaltunnel_transport": schema.StringAttribute{
+				MarkdownDescription: "How the internal tunnel reaches the wireguard gateway: `udp`, `websocket` to carry it over https for networks that block udp, or `auto` to try udp and fall back to websockets when the gateway doesn't answer. Defaults to `udp`",
+				Optional:            true,
+			},
+			"tunnel_gc_max_age": schema.StringAttribute{
+				MarkdownDescription: "Remove the org's `terraform-tunnel-*` wireguard peers older than this, as a duration like `24h`, before opening the internal tunnel. Peers are left behind when the provider is killed before it can remove its own. Keep this well above the longest terraform run, peers of runs still going are removed too",
+				Optional:            true,
+			},
+			"tunnel_peer_cache": schema.BoolAttribute{
+				MarkdownDescription: "Keep the internal tunnel's wireguard peer in a file and reuse it in later runs instead of registering a new one each time. Runs sharing the cache can overlap: a cached peer is locked by the run using it, and a run that finds it locked registers a peer of its own",
+				Optional:            true,
+			},
+			"tunnel_peer_cache_path": schema.StringAttribute{
+				MarkdownDescription: "Path of the tunnel peer cache, setting it turns the cache on. Defaults to `terraform-provider-fly/wireguard-peers.json` in the user cache directory",
+				Optional:            true,
+			},
+			"graphql_timeout": schema.StringAttribute{
+				MarkdownDescription: "Timeout of graphql api requests, as a duration like `60s`, retries included. If not set checks env for FLY_GRAPHQL_TIMEOUT, defaults to 60s",
+				Optional:            true,
+			},
+			"machines_timeout": schema.StringAttribute{
+				MarkdownDescription: "Timeout of machines api requests, as a duration like `2m`, retries included. If not set checks env for FLY_MACHINES_TIMEOUT, defaults to 2m",
+				Optional:            true,
+			},
 		},
 	}
 }
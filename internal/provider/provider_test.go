@@ -3,8 +3,10 @@ package provider
 import (
 	"fmt"
 	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -50,3 +52,18 @@ provider "fly" {
 }
 `, getTestOrg(), getTestRegion())
 }
+
+func TestTunnelSettings(t *testing.T) {
+	var data providerData
+	if set := data.tunnelSettings(); len(set) != 0 {
+		t.Errorf("got %v for an empty config, want none", set)
+	}
+
+	data.TunnelConfigFile = types.StringValue("peer.conf")
+	data.TunnelMtu = types.Int64Value(1280)
+	data.InternalTunnelRegion = types.StringValue("ord")
+	want := []string{"internaltunnel_config_file", "internaltunnel_mtu"}
+	if set := data.tunnelSettings(); !reflect.DeepEqual(set, want) {
+		t.Errorf("got %v, want %v", set, want)
+	}
+}
@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMaxRetries   = 3
+	DefaultRetryMaxWait = 30 * time.Second
+
+	retryBaseWait = 500 * time.Millisecond
+)
+
+// RetryTransport retries requests that failed with a connection error or a 429, 502, 503 or 504, waiting with
+// exponential backoff and jitter, or as long as Retry-After asks for. Only requests that are safe to send twice are
+// retried: idempotent methods and graphql queries. Other requests, machine updates made under a lease among them,
+// may already have been applied when the connection fails or the gateway gives up, so they are only retried on 429,
+// which the api answers without acting on the request.
+type RetryTransport struct {
+	UnderlyingTransport http.RoundTripper
+	MaxRetries          int
+	MaxWait             time.Duration
+}
+
+type noRetriesKey struct{}
+
+// WithoutRetries marks requests made with ctx to be sent only once, for calls that have to finish quickly.
+func WithoutRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetriesKey{}, true)
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Value(noRetriesKey{}) != nil {
+		return t.UnderlyingTransport.RoundTrip(req)
+	}
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	idempotent := replayable && isIdempotent(req)
+
+	for attempt := 0; ; attempt++ {
+		// The caller's request must not be modified, later attempts send a copy with a fresh body.
+		attemptReq := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		res, err := t.UnderlyingTransport.RoundTrip(attemptReq)
+		if attempt >= t.MaxRetries || !replayable || !shouldRetry(res, err, idempotent) {
+			return res, err
+		}
+
+		wait := RetryBackoff(attempt, t.MaxWait)
+		if res != nil {
+			if after, ok := retryAfter(res, t.MaxWait); ok {
+				wait = after
+			}
+			// Drain so the connection can be reused.
+			_, _ = io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// RetryBackoff returns how long to wait before retry attempt+1: exponential from half a second with full jitter,
+// capped at max.
+func RetryBackoff(attempt int, max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	wait := retryBaseWait << attempt
+	if wait > max || wait <= 0 {
+		wait = max
+	}
+	return time.Duration(rand.Int63n(int64(wait)) + 1)
+}
+
+func shouldRetry(res *http.Response, err error, idempotent bool) bool {
+	if err != nil {
+		return idempotent && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		return isGraphqlQuery(req)
+	}
+	return false
+}
+
+// isGraphqlQuery reports whether req is a graphql query rather than a mutation.
+func isGraphqlQuery(req *http.Request) bool {
+	if req.GetBody == nil || !strings.HasSuffix(req.URL.Path, "/graphql") {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	defer body.Close()
+	var payload struct {
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(body).Decode(&payload); err != nil {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimSpace(payload.Query), "query")
+}
+
+// retryAfter parses the Retry-After header, given either in seconds or as a date.
+func retryAfter(res *http.Response, max time.Duration) (time.Duration, bool) {
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = time.Until(date)
+	} else {
+		return 0, false
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait, true
+}
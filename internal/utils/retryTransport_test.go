@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newRequest(t *testing.T, method string, url string, body string) *http.Request {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestIsIdempotent(t *testing.T) {
+	withNonce := newRequest(t, http.MethodPost, "https://api.machines.dev/v1/apps/a/machines/m", "{}")
+	withNonce.Header.Set("fly-machine-lease-nonce", "nonce")
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want bool
+	}{
+		{"get", newRequest(t, http.MethodGet, "https://api.machines.dev/v1/apps/a/machines", ""), true},
+		{"delete", newRequest(t, http.MethodDelete, "https://api.machines.dev/v1/apps/a/machines/m", ""), true},
+		{"post", newRequest(t, http.MethodPost, "https://api.machines.dev/v1/apps/a/machines", "{}"), false},
+		{"post with lease nonce", withNonce, false},
+		{"patch", newRequest(t, http.MethodPatch, "https://api.machines.dev/v1/apps/a", "{}"), false},
+		{"graphql query", newRequest(t, http.MethodPost, "https://api.fly.io/graphql", `{"query": " query App { app { id } }"}`), true},
+		{"graphql mutation", newRequest(t, http.MethodPost, "https://api.fly.io/graphql", `{"query": "mutation CreateApp { createApp { id } }"}`), false},
+		{"graphql bad body", newRequest(t, http.MethodPost, "https://api.fly.io/graphql", `query App`), false},
+		{"query elsewhere", newRequest(t, http.MethodPost, "https://api.fly.io/other", `{"query": "query App { app { id } }"}`), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isIdempotent(tt.req); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	status := func(code int) *http.Response { return &http.Response{StatusCode: code} }
+	tests := []struct {
+		name       string
+		res        *http.Response
+		err        error
+		idempotent bool
+		want       bool
+	}{
+		{"connection error", nil, errors.New("connection reset"), true, true},
+		{"connection error not idempotent", nil, errors.New("connection reset"), false, false},
+		{"canceled", nil, context.Canceled, true, false},
+		{"deadline", nil, context.DeadlineExceeded, true, false},
+		{"429", status(http.StatusTooManyRequests), nil, false, true},
+		{"503", status(http.StatusServiceUnavailable), nil, true, true},
+		{"503 not idempotent", status(http.StatusServiceUnavailable), nil, false, false},
+		{"500", status(http.StatusInternalServerError), nil, true, false},
+		{"200", status(http.StatusOK), nil, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldRetry(tt.res, tt.err, tt.idempotent); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	header := func(value string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": []string{value}}}
+	}
+	tests := []struct {
+		name   string
+		res    *http.Response
+		want   time.Duration
+		wantOk bool
+	}{
+		{"missing", &http.Response{Header: http.Header{}}, 0, false},
+		{"seconds", header("3"), 3 * time.Second, true},
+		{"seconds over max", header("120"), time.Minute, true},
+		{"past date", header(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)), 0, true},
+		{"invalid", header("soon"), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := retryAfter(tt.res, time.Minute)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("got %s %t, want %s %t", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+
+	date := header(time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat))
+	got, ok := retryAfter(date, time.Minute)
+	if !ok || got <= 8*time.Second || got > 10*time.Second {
+		t.Errorf("date: got %s %t, want about 10s", got, ok)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestRetryTransportLeavesRequestAlone(t *testing.T) {
+	var bodies []string
+	var attempts []*http.Request
+	transport := &RetryTransport{
+		MaxRetries: 2,
+		MaxWait:    time.Millisecond,
+		UnderlyingTransport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			body, _ := io.ReadAll(req.Body)
+			bodies = append(bodies, string(body))
+			attempts = append(attempts, req)
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(&bytes.Buffer{})}, nil
+		}),
+	}
+	req := newRequest(t, http.MethodPut, "https://api.machines.dev/v1/apps/a", "payload")
+	originalBody := req.Body
+
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusServiceUnavailable || len(bodies) != 3 {
+		t.Fatalf("got status %d after %d attempts, want 503 after 3", res.StatusCode, len(bodies))
+	}
+	for i, body := range bodies {
+		if body != "payload" {
+			t.Errorf("attempt %d sent body %q", i, body)
+		}
+	}
+	if req.Body != originalBody {
+		t.Error("the caller's request body was replaced")
+	}
+	if attempts[1] == req || attempts[2] == req {
+		t.Error("retries reused the caller's request")
+	}
+}
@@ -0,0 +1,284 @@
+package wg
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	rawgql "github.com/Khan/genqlient/graphql"
+)
+
+// handshakeTimeout is how long a cached peer gets to complete a handshake before it is considered rejected.
+const handshakeTimeout = 10 * time.Second
+
+// PeerCache keeps the state of registered peers on disk, one per org and region, so later runs can reuse them
+// instead of registering a new peer each time. The api token is not stored. The file is locked while it is changed,
+// so provider processes can share it.
+type PeerCache struct {
+	Path string
+}
+
+// DefaultPeerCachePath is where the cache is kept when no path is configured.
+func DefaultPeerCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "terraform-provider-fly", "wireguard-peers.json"), nil
+}
+
+func peerCacheKey(org string, region string) string {
+	return org + "/" + region
+}
+
+// locked runs fn with the cache file locked against other processes.
+func (c PeerCache) locked(fn func() error) error {
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(c.Path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if _, err := lockFile(lock, true); err != nil {
+		return fmt.Errorf("locking peer cache %s: %w", c.Path, err)
+	}
+	return fn()
+}
+
+func (c PeerCache) read() (map[string]WireGuardState, error) {
+	states := map[string]WireGuardState{}
+	data, err := os.ReadFile(c.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("reading peer cache %s: %w", c.Path, err)
+	}
+	return states, nil
+}
+
+func (c PeerCache) write(states map[string]WireGuardState) error {
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write and rename so a reader that doesn't lock never sees half a file.
+	tmp := c.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.Path)
+}
+
+// Load returns the cached peer of org in region.
+func (c PeerCache) Load(org string, region string) (*WireGuardState, error) {
+	var state *WireGuardState
+	err := c.locked(func() error {
+		states, err := c.read()
+		if err != nil {
+			return err
+		}
+		if s, ok := states[peerCacheKey(org, region)]; ok {
+			state = &s
+		}
+		return nil
+	})
+	return state, err
+}
+
+// Store caches state as the peer of its org and region.
+func (c PeerCache) Store(state WireGuardState) error {
+	return c.locked(func() error {
+		states, err := c.read()
+		if err != nil {
+			return err
+		}
+		state.Token = ""
+		states[peerCacheKey(state.Org, state.Region)] = state
+		return c.write(states)
+	})
+}
+
+// Remove drops the cached peer of org in region.
+func (c PeerCache) Remove(org string, region string) error {
+	return c.locked(func() error {
+		states, err := c.read()
+		if err != nil {
+			return err
+		}
+		delete(states, peerCacheKey(org, region))
+		return c.write(states)
+	})
+}
+
+// Names returns the names of all cached peers.
+func (c PeerCache) Names() ([]string, error) {
+	var names []string
+	err := c.locked(func() error {
+		states, err := c.read()
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			names = append(names, s.Name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// peerClaim is the right to connect with the cached peer of an org and region. A peer can only be connected from
+// one place at a time, so the claim is a lock on a file next to the cache, held by whichever tunnel uses the peer,
+// in this process or another. The os releases it if the process dies.
+type peerClaim struct {
+	file *os.File
+}
+
+var unsafeClaimChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// claim takes the claim on the cached peer of org in region, it returns nil if another tunnel holds it.
+func (c PeerCache) claim(org string, region string) (*peerClaim, error) {
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0700); err != nil {
+		return nil, err
+	}
+	name := unsafeClaimChars.ReplaceAllString(peerCacheKey(org, region), "_")
+	file, err := os.OpenFile(c.Path+"."+name+".claim", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := lockFile(file, false)
+	if err != nil || !ok {
+		file.Close()
+		return nil, err
+	}
+	return &peerClaim{file: file}, nil
+}
+
+func (p *peerClaim) release() {
+	if p != nil {
+		p.file.Close()
+	}
+}
+
+// EstablishCached opens a tunnel with the peer cached for org and region, checking it with a handshake. A new peer
+// is registered, and cached, when there is none or the cached one was removed or is rejected. Tunnels of cached
+// peers keep their peer registered when they are taken down. When another tunnel, in this process or another, is
+// using the cached peer, this one gets a peer of its own that is removed when it is taken down.
+func EstablishCached(ctx context.Context, org string, region string, token string, client *rawgql.Client, cache PeerCache, opts Options) (*Tunnel, error) {
+	claim, err := cache.claim(org, region)
+	if err != nil {
+		return nil, err
+	}
+	if claim == nil {
+		return Establish(ctx, org, region, token, client, opts)
+	}
+
+	cached, err := cache.Load(org, region)
+	if err != nil {
+		claim.release()
+		return nil, err
+	}
+
+	if cached != nil {
+		cached.Token = token
+		tunnel, err := connectPeer(ctx, cached, client, opts)
+		if err == nil {
+			err = tunnel.waitForHandshake(ctx, handshakeTimeout)
+			if err == nil {
+				tunnel.cached = true
+				tunnel.cache = &cache
+				tunnel.claim = claim
+				return tunnel, nil
+			}
+			// The peer is unusable, remove it if it still exists. Errors are expected as it is likely gone already.
+			_ = tunnel.Down()
+		}
+		if err := cache.Remove(org, region); err != nil {
+			claim.release()
+			return nil, err
+		}
+	}
+
+	tunnel, err := Establish(ctx, org, region, token, client, opts)
+	if err != nil {
+		claim.release()
+		return nil, err
+	}
+	if err := cache.Store(*tunnel.State); err != nil {
+		claim.release()
+		return tunnel, fmt.Errorf("caching wireguard peer: %w", err)
+	}
+	tunnel.cached = true
+	tunnel.cache = &cache
+	tunnel.claim = claim
+	return tunnel, nil
+}
+
+// lastHandshake returns when the tunnel last completed a handshake with the gateway, zero if it never did.
+func (t *Tunnel) lastHandshake() (time.Time, error) {
+	t.mu.RLock()
+	dev := t.dev
+	t.mu.RUnlock()
+	if dev == nil {
+		return time.Time{}, errors.New("tunnel is down")
+	}
+	ipc, err := dev.IpcGet()
+	if err != nil {
+		return time.Time{}, err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(ipc))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok && key == "last_handshake_time_sec" {
+			sec, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || sec == 0 {
+				return time.Time{}, err
+			}
+			return time.Unix(sec, 0), nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// waitForHandshake sends traffic through the tunnel until the gateway answers the handshake it triggers.
+func (t *Tunnel) waitForHandshake(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		dialCtx, dialCancel := context.WithTimeout(ctx, time.Second)
+		c, err := t.DialContext(dialCtx, "tcp", net.JoinHostPort(t.dnsIP.String(), "53"))
+		dialCancel()
+		if err == nil {
+			c.Close()
+		}
+		handshake, err := t.lastHandshake()
+		if err != nil {
+			return err
+		}
+		if !handshake.IsZero() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("no handshake with the wireguard gateway, the peer was likely removed")
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
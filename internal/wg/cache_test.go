@@ -0,0 +1,59 @@
+package wg
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestPeerCacheClaim(t *testing.T) {
+	cache := PeerCache{Path: filepath.Join(t.TempDir(), "peers.json")}
+
+	first, err := cache.claim("org", "ams")
+	if err != nil || first == nil {
+		t.Fatalf("first claim: %v %v", first, err)
+	}
+	second, err := cache.claim("org", "ams")
+	if err != nil || second != nil {
+		t.Fatalf("second claim of a held peer: %v %v", second, err)
+	}
+	other, err := cache.claim("org", "ord")
+	if err != nil || other == nil {
+		t.Fatalf("claim of another region: %v %v", other, err)
+	}
+	other.release()
+
+	first.release()
+	again, err := cache.claim("org", "ams")
+	if err != nil || again == nil {
+		t.Fatalf("claim after release: %v %v", again, err)
+	}
+	again.release()
+}
+
+func TestPeerCacheConcurrentStores(t *testing.T) {
+	cache := PeerCache{Path: filepath.Join(t.TempDir(), "peers.json")}
+	regions := []string{"ams", "ord", "iad", "syd", "nrt", "gru", "lhr", "fra"}
+
+	var done sync.WaitGroup
+	for _, region := range regions {
+		done.Add(1)
+		go func(region string) {
+			defer done.Done()
+			if err := cache.Store(WireGuardState{Org: "org", Region: region, Name: "peer-" + region, Token: "secret"}); err != nil {
+				t.Error(err)
+			}
+		}(region)
+	}
+	done.Wait()
+
+	for _, region := range regions {
+		state, err := cache.Load("org", region)
+		if err != nil || state == nil {
+			t.Fatalf("%s was lost: %v %v", region, state, err)
+		}
+		if state.Token != "" {
+			t.Errorf("%s: token was stored", region)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package wg
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ParseConfig reads a wg-quick style config, like the ones `fly wireguard create` writes, into a Config. Only the
+// settings the tunnel uses are read: the interface's PrivateKey, Address, DNS and MTU, and the peer's PublicKey,
+// AllowedIPs, Endpoint and PersistentKeepalive. Other settings are ignored.
+func ParseConfig(text string) (*Config, error) {
+	cfg := &Config{}
+	var section string
+	var hasPrivateKey, hasPublicKey bool
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for line := 1; scanner.Scan(); line++ {
+		content, _, _ := strings.Cut(scanner.Text(), "#")
+		content = strings.TrimSpace(content)
+		if content == "" {
+			continue
+		}
+		if strings.HasPrefix(content, "[") && strings.HasSuffix(content, "]") {
+			section = strings.ToLower(strings.TrimSpace(content[1 : len(content)-1]))
+			if section != "interface" && section != "peer" {
+				return nil, fmt.Errorf("line %d: unknown section %s", line, content)
+			}
+			if section == "peer" && hasPublicKey {
+				return nil, fmt.Errorf("line %d: only one peer is supported", line)
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(content, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", line)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch section + "." + key {
+		case "interface.privatekey":
+			err = cfg.LocalPrivateKey.UnmarshalText([]byte(value))
+			hasPrivateKey = true
+		case "interface.address":
+			cfg.LocalNetwork, err = parseAddress(value)
+		case "interface.dns":
+			cfg.DNS = net.ParseIP(strings.TrimSpace(strings.Split(value, ",")[0]))
+			if cfg.DNS == nil {
+				err = fmt.Errorf("invalid address %q", value)
+			}
+		case "interface.mtu":
+			cfg.MTU, err = strconv.Atoi(value)
+		case "peer.publickey":
+			err = cfg.RemotePublicKey.UnmarshalText([]byte(value))
+			hasPublicKey = true
+		case "peer.allowedips":
+			if strings.Contains(value, ",") {
+				err = errors.New("only one allowed network is supported")
+			} else {
+				_, cfg.RemoteNetwork, err = net.ParseCIDR(value)
+			}
+		case "peer.endpoint":
+			_, _, err = net.SplitHostPort(value)
+			cfg.Endpoint = value
+		case "peer.persistentkeepalive":
+			if strings.EqualFold(value, "off") {
+				cfg.KeepAlive = -1
+				break
+			}
+			cfg.KeepAlive, err = strconv.Atoi(value)
+			if err == nil && cfg.KeepAlive == 0 {
+				cfg.KeepAlive = -1
+			}
+		default:
+			if section == "" {
+				return nil, fmt.Errorf("line %d: %s is outside of a section", line, key)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", line, key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case !hasPrivateKey:
+		return nil, errors.New("the interface has no PrivateKey")
+	case cfg.LocalNetwork == nil:
+		return nil, errors.New("the interface has no Address")
+	case cfg.DNS == nil:
+		return nil, errors.New("the interface has no DNS")
+	case !hasPublicKey:
+		return nil, errors.New("there is no peer with a PublicKey")
+	case cfg.RemoteNetwork == nil:
+		return nil, errors.New("the peer has no AllowedIPs")
+	case cfg.Endpoint == "":
+		return nil, errors.New("the peer has no Endpoint")
+	}
+	return cfg, nil
+}
+
+// parseAddress parses the interface address, keeping the host's own ip rather than the network's.
+func parseAddress(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(strings.Split(value, ",")[0])
+	ip, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, err
+	}
+	return &net.IPNet{IP: ip, Mask: network.Mask}, nil
+}
+
+// LoadConfigFile parses the wg-quick style config in the file at path.
+func LoadConfigFile(path string) (*Config, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseConfig(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// EstablishConfig opens a tunnel with a peer that was registered elsewhere, like with `fly wireguard create`. The
+// peer is left registered when the tunnel is taken down.
+func EstablishConfig(ctx context.Context, cfg *Config, opts Options) (*Tunnel, error) {
+	tunnel, err := connect(ctx, cfg, opts)
+	if err != nil {
+		return nil, errors.New("tunnel error (doConnect): " + err.Error())
+	}
+	tunnel.static = cfg
+	return tunnel, nil
+}
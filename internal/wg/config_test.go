@@ -0,0 +1,122 @@
+package wg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testKey = "AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyA="
+
+const testConfig = `# written by fly wireguard create
+[Interface]
+PrivateKey = ` + testKey + `
+Address = fdaa:0:1:a7b:1f0:0:a:2/120
+DNS = fdaa:0:1::3 # the org's dns
+MTU = 1380
+
+[Peer]
+PublicKey = ` + testKey + `
+AllowedIPs = fdaa:0:1::/48
+Endpoint = ams1.gateway.6pn.dev:51820
+PersistentKeepalive = 15
+`
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LocalNetwork.String() != "fdaa:0:1:a7b:1f0:0:a:2/120" {
+		t.Errorf("address: got %s", cfg.LocalNetwork)
+	}
+	if cfg.DNS.String() != "fdaa:0:1::3" {
+		t.Errorf("dns: got %s", cfg.DNS)
+	}
+	if cfg.RemoteNetwork.String() != "fdaa:0:1::/48" {
+		t.Errorf("allowed ips: got %s", cfg.RemoteNetwork)
+	}
+	if cfg.Endpoint != "ams1.gateway.6pn.dev:51820" || cfg.MTU != 1380 || cfg.KeepAlive != 15 {
+		t.Errorf("got endpoint %s, mtu %d, keepalive %d", cfg.Endpoint, cfg.MTU, cfg.KeepAlive)
+	}
+	if cfg.LocalPrivateKey[0] != 1 || cfg.RemotePublicKey[31] != 32 {
+		t.Errorf("keys were not decoded")
+	}
+}
+
+func TestParseConfigKeepAliveOff(t *testing.T) {
+	for _, value := range []string{"0", "off"} {
+		cfg, err := ParseConfig(strings.Replace(testConfig, "PersistentKeepalive = 15", "PersistentKeepalive = "+value, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.KeepAlive != -1 {
+			t.Errorf("%s: got keepalive %d, want -1", value, cfg.KeepAlive)
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	without := func(key string) string {
+		var lines []string
+		for _, line := range strings.Split(testConfig, "\n") {
+			if !strings.HasPrefix(line, key+" ") {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"multiple allowed ips", strings.Replace(testConfig, "fdaa:0:1::/48", "fdaa:0:1::/48, fdaa:0:2::/48", 1), "only one allowed network"},
+		{"invalid private key", strings.Replace(testConfig, "PrivateKey = "+testKey, "PrivateKey = not-base64!", 1), "line 3: privatekey"},
+		{"short public key", strings.Replace(testConfig, "PublicKey = "+testKey, "PublicKey = AQID", 1), "line 9: publickey"},
+		{"invalid address", strings.Replace(testConfig, "/120", "/999", 1), "line 4: address"},
+		{"endpoint without port", strings.Replace(testConfig, ":51820", "", 1), "line 11: endpoint"},
+		{"missing private key", without("PrivateKey"), "no PrivateKey"},
+		{"missing address", without("Address"), "no Address"},
+		{"missing dns", without("DNS"), "no DNS"},
+		{"missing public key", without("PublicKey"), "no peer with a PublicKey"},
+		{"missing allowed ips", without("AllowedIPs"), "no AllowedIPs"},
+		{"missing endpoint", without("Endpoint"), "no Endpoint"},
+		{"second peer", testConfig + "[Peer]\n", "only one peer"},
+		{"unknown section", "[Other]\n", "unknown section"},
+		{"outside section", "PrivateKey = " + testKey + "\n", "outside of a section"},
+		{"not key value", "[Interface]\nPrivateKey\n", "expected key = value"},
+		{"empty", "", "no PrivateKey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfig(tt.config)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	// Brackets in the path must not be taken for config content.
+	path := filepath.Join(t.TempDir(), "[fly]", "tunnel.conf")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("[Interface]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadConfigFile(path)
+	if err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("got error %v, want one naming the file", err)
+	}
+}
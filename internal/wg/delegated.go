@@ -0,0 +1,132 @@
+package wg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fly-apps/terraform-provider-fly/graphql"
+)
+
+// DelegatedPeers registers peers with a delegated wireguard token, made with createDelegatedWireGuardToken or
+// `fly wireguard token create`. The token can only add and remove the peers of its org, unlike an api token.
+type DelegatedPeers struct {
+	// Endpoint is the fly api, like https://api.fly.io.
+	Endpoint string
+	Token    string
+	Client   *http.Client
+}
+
+type delegatedPeerRequest struct {
+	Name   string `json:"name"`
+	Pubkey string `json:"pubkey"`
+	Region string `json:"region,omitempty"`
+}
+
+type delegatedPeerResponse struct {
+	Us     string `json:"us"`
+	Them   string `json:"them"`
+	Pubkey string `json:"key"`
+	Error  string `json:"error"`
+}
+
+func (d DelegatedPeers) do(ctx context.Context, method string, name string, body any) (*delegatedPeerResponse, error) {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = bytes.NewReader(data)
+	}
+	u := strings.TrimSuffix(d.Endpoint, "/") + "/api/v3/wire_guard_peers"
+	if name != "" {
+		u += "/" + url.PathEscape(name)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+d.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var peer delegatedPeerResponse
+	if res.StatusCode >= 300 {
+		_ = json.NewDecoder(res.Body).Decode(&peer)
+		if peer.Error != "" {
+			return nil, fmt.Errorf("%s: %s", res.Status, peer.Error)
+		}
+		return nil, errors.New(res.Status)
+	}
+	if method == http.MethodDelete {
+		return nil, nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(&peer); err != nil {
+		return nil, err
+	}
+	if peer.Error != "" {
+		return nil, errors.New(peer.Error)
+	}
+	return &peer, nil
+}
+
+// register adds a new peer in region, with a fresh key pair.
+func (d DelegatedPeers) register(ctx context.Context, region string) (*WireGuardState, error) {
+	name := newPeerName()
+	public, private := C25519pair()
+	peer, err := d.do(ctx, http.MethodPost, "", delegatedPeerRequest{Name: name, Pubkey: public, Region: region})
+	if err != nil {
+		return nil, fmt.Errorf("adding wireguard peer with delegated token: %w", err)
+	}
+	return &WireGuardState{
+		Name:         name,
+		Region:       region,
+		LocalPrivate: private,
+		LocalPublic:  public,
+		Peer: graphql.AddWireguardPeerAddWireGuardPeerAddWireGuardPeerPayload{
+			Peerip:     peer.Us,
+			Endpointip: peer.Them,
+			Pubkey:     peer.Pubkey,
+		},
+	}, nil
+}
+
+func (d DelegatedPeers) remove(ctx context.Context, name string) error {
+	_, err := d.do(ctx, http.MethodDelete, name, nil)
+	if err != nil {
+		return fmt.Errorf("removing wireguard peer %s: %w", name, err)
+	}
+	return nil
+}
+
+// EstablishDelegated registers a peer in region with a delegated wireguard token and opens a tunnel with it. The
+// peer is removed with the same token when the tunnel is taken down.
+func EstablishDelegated(ctx context.Context, region string, peers DelegatedPeers, opts Options) (*Tunnel, error) {
+	state, err := peers.register(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := connectPeer(ctx, state, nil, opts)
+	if err != nil {
+		_ = peers.remove(ctx, state.Name)
+		return nil, errors.New("tunnel error (doConnect): " + err.Error())
+	}
+	tunnel.delegated = &peers
+	return tunnel, nil
+}
@@ -0,0 +1,177 @@
+package wg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+const (
+	// superviseInterval is how often the supervisor checks the tunnel.
+	superviseInterval = 30 * time.Second
+	// staleHandshake is how old the last handshake can be before the gateway drops the session, wireguard's
+	// reject-after-time.
+	staleHandshake = 180 * time.Second
+	// apiProbeAddress is what the supervisor dials to check that the tunnel carries traffic.
+	apiProbeAddress = "_api.internal:4280"
+	probeTimeout    = 5 * time.Second
+	// peerCleanupTimeout bounds removing the peer of a failed reconnect.
+	peerCleanupTimeout = 30 * time.Second
+)
+
+// detachedContext keeps the values of its parent, like the terraform logger, without its cancellation. The context
+// of the request that opened the tunnel ends long before the tunnel does.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// Supervise checks the tunnel periodically until it is taken down, rebuilding it when it stops carrying traffic.
+// The device is rebuilt first, with the same peer, and if the gateway still doesn't answer a new peer is registered.
+// ctx only provides the logger, the supervisor stops with Down.
+func (t *Tunnel) Supervise(ctx context.Context) {
+	ctx, cancel := context.WithCancel(detachedContext{ctx})
+	t.supervisor = cancel
+	go func() {
+		ticker := time.NewTicker(superviseInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				t.check(ctx)
+			}
+		}
+	}()
+}
+
+func (t *Tunnel) check(ctx context.Context) {
+	handshake, err := t.lastHandshake()
+	if err != nil {
+		return
+	}
+	probeErr := t.probe(ctx)
+	tflog.Debug(ctx, "wireguard tunnel status", map[string]interface{}{
+		"peer":           t.peerName(),
+		"last_handshake": handshake.Format(time.RFC3339),
+		"probe_error":    fmt.Sprint(probeErr),
+	})
+	if probeErr == nil {
+		return
+	}
+
+	if !handshake.IsZero() && time.Since(handshake) < staleHandshake {
+		// The session is alive, the api itself is having trouble.
+		return
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("wireguard tunnel is not carrying traffic, rebuilding it: %s", probeErr))
+	err = t.rebuild(ctx, t.State)
+	if err == nil {
+		err = t.probe(ctx)
+	}
+	if err == nil {
+		tflog.Info(ctx, "wireguard tunnel rebuilt")
+		return
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("wireguard tunnel still down, registering a new peer: %s", err))
+	err = t.reregister(ctx)
+	if err != nil {
+		tflog.Warn(ctx, fmt.Sprintf("failed to reconnect wireguard tunnel: %s", err))
+		return
+	}
+	tflog.Info(ctx, fmt.Sprintf("wireguard tunnel reconnected with peer %s", t.peerName()))
+}
+
+// peerName names the tunnel's peer in logs, tunnels opened from a config don't know theirs.
+func (t *Tunnel) peerName() string {
+	if t.State == nil {
+		return "(from config)"
+	}
+	return t.State.Name
+}
+
+// probe dials the machines api through the tunnel.
+func (t *Tunnel) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	c, err := t.DialContext(ctx, "tcp", apiProbeAddress)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// rebuild replaces the device and network stack with fresh ones connected as state, or with the tunnel's fixed
+// config when it has one.
+func (t *Tunnel) rebuild(ctx context.Context, state *WireGuardState) error {
+	cfg := t.static
+	if state != nil {
+		cfg = state.TunnelConfig()
+	}
+	fresh, err := connect(ctx, cfg, t.options)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	if ctx.Err() != nil {
+		// Taken down while this was connecting.
+		t.mu.Unlock()
+		fresh.closeDevice()
+		return ctx.Err()
+	}
+	old, oldcancel := t.dev, t.wscancel
+	t.dev, t.tun, t.net, t.resolv, t.wscancel = fresh.dev, fresh.tun, fresh.net, fresh.resolv, fresh.wscancel
+	t.dnsIP, t.Config, t.State = fresh.dnsIP, fresh.Config, state
+	t.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	if oldcancel != nil {
+		oldcancel()
+	}
+	return t.waitForHandshake(ctx, handshakeTimeout)
+}
+
+// reregister replaces the tunnel's peer with a newly registered one, which takes the old one's place in the cache.
+func (t *Tunnel) reregister(ctx context.Context) error {
+	if t.State == nil {
+		return errors.New("the tunnel was opened from a config, there is no new peer to register")
+	}
+	old := *t.State
+	var peer *WireGuardState
+	var err error
+	if t.delegated != nil {
+		peer, err = t.delegated.register(ctx, old.Region)
+	} else {
+		peer, err = registerPeer(ctx, old.Org, old.Region, old.Token, t.apiClient)
+	}
+	if err != nil {
+		return err
+	}
+	err = t.rebuild(ctx, peer)
+	if err != nil {
+		// ctx may be what ended the rebuild, the new peer is removed regardless.
+		cleanupCtx, cancel := context.WithTimeout(detachedContext{ctx}, peerCleanupTimeout)
+		defer cancel()
+		_ = t.dropPeer(cleanupCtx, peer)
+		return err
+	}
+
+	if t.cached && t.cache != nil {
+		if err := t.cache.Store(*peer); err != nil {
+			tflog.Warn(ctx, fmt.Sprintf("failed to cache wireguard peer: %s", err))
+		}
+	}
+	// Best effort, the old peer is most likely gone already.
+	_ = t.dropPeer(ctx, &old)
+	return nil
+}
@@ -4,12 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	rawgql "github.com/Khan/genqlient/graphql"
 	"github.com/fly-apps/terraform-provider-fly/graphql"
+	"github.com/fly-apps/terraform-provider-fly/internal/utils"
 	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
 	"github.com/miekg/dns"
 	"golang.org/x/crypto/curve25519"
 	"golang.zx2c4.com/wireguard/conn"
@@ -21,6 +24,8 @@ import (
 	"net/http"
 	"net/netip"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -142,6 +147,25 @@ func (s *WireGuardState) TunnelConfig() *Config {
 	}
 }
 
+// Options tune the tunnel device, zero values leave the defaults.
+type Options struct {
+	// MTU of the tunnel interface, defaults to 1420.
+	MTU int
+	// KeepAlive is the interval in seconds of keepalive packets, which keep nat mappings open while the tunnel is
+	// idle. Defaults to DefaultKeepAlive, a negative value turns them off.
+	KeepAlive int
+	// LogLevel of the device, one of the device.LogLevel constants. Device logs go to the terraform logger.
+	LogLevel int
+	// Transport carries the wireguard packets, one of TransportUDP, TransportWebSocket or TransportAuto. Defaults
+	// to udp.
+	Transport string
+	// TLSConfig verifies the gateway when the packets go over websockets, the system roots are used when it is nil.
+	TLSConfig *tls.Config
+}
+
+// DefaultKeepAlive is the keepalive interval in seconds used when Options doesn't set one.
+const DefaultKeepAlive = 25
+
 type Tunnel struct {
 	dev       *device.Device
 	tun       tun.Device
@@ -151,12 +175,57 @@ type Tunnel struct {
 	Config    *Config
 	apiClient *rawgql.Client
 
+	// static is the config of tunnels opened with EstablishConfig, which have no peer of their own to manage.
+	static *Config
+	// delegated registers the peers of tunnels opened with EstablishDelegated.
+	delegated *DelegatedPeers
+
 	wscancel func()
 	resolv   *net.Resolver
+	// logCtx carries the terraform logger of the request that opened the tunnel, for logging after it ended.
+	logCtx context.Context
+
+	// cached is set for tunnels of peers kept in a PeerCache, their peer outlives the tunnel.
+	cached  bool
+	cache   *PeerCache
+	claim   *peerClaim
+	options Options
+
+	// mu guards the device and network stack, which the supervisor replaces when it rebuilds the tunnel.
+	mu         sync.RWMutex
+	supervisor context.CancelFunc
 }
 
-func doConnect(_ context.Context, state *WireGuardState, apiClient *rawgql.Client) (*Tunnel, error) {
-	cfg := state.TunnelConfig()
+// deviceLogger sends the device's logs to the terraform logger in ctx.
+func deviceLogger(ctx context.Context, level int) *device.Logger {
+	logger := &device.Logger{Verbosef: device.DiscardLogf, Errorf: device.DiscardLogf}
+	if level >= device.LogLevelVerbose {
+		logger.Verbosef = func(format string, args ...any) {
+			tflog.Debug(ctx, "wireguard: "+fmt.Sprintf(format, args...))
+		}
+	}
+	if level >= device.LogLevelError {
+		logger.Errorf = func(format string, args ...any) {
+			tflog.Error(ctx, "wireguard: "+fmt.Sprintf(format, args...))
+		}
+	}
+	return logger
+}
+
+func doConnect(ctx context.Context, config *Config, opts Options) (*Tunnel, error) {
+	cfg := *config
+	if opts.MTU != 0 {
+		cfg.MTU = opts.MTU
+	}
+	if opts.KeepAlive != 0 {
+		cfg.KeepAlive = opts.KeepAlive
+	}
+	cfg.LogLevel = opts.LogLevel
+	if cfg.KeepAlive == 0 {
+		cfg.KeepAlive = DefaultKeepAlive
+	} else if cfg.KeepAlive < 0 {
+		cfg.KeepAlive = 0
+	}
 
 	localNetworkIp, _ := netip.AddrFromSlice(cfg.LocalNetwork.IP)
 	localIPs := []netip.Addr{localNetworkIp}
@@ -185,8 +254,6 @@ func doConnect(_ context.Context, state *WireGuardState, apiClient *rawgql.Clien
 	endpointIP := endpointIPs[rand.Intn(len(endpointIPs))]
 	endpointAddr := net.JoinHostPort(endpointIP.String(), endpointPort)
 
-	wgDev := device.NewDevice(tunDev, conn.NewDefaultBind(), device.NewLogger(cfg.LogLevel, "(fly-provider-tunnel) "))
-
 	wgConf := bytes.NewBuffer(nil)
 	_, err = fmt.Fprintf(wgConf, "private_key=%s\n", cfg.LocalPrivateKey.ToHex())
 	_, err = fmt.Fprintf(wgConf, "public_key=%s\n", cfg.RemotePublicKey.ToHex())
@@ -197,22 +264,37 @@ func doConnect(_ context.Context, state *WireGuardState, apiClient *rawgql.Clien
 		return nil, errors.New("error setting wgConf (fmt.Fprintf): " + err.Error())
 	}
 
+	var bind conn.Bind = conn.NewDefaultBind()
+	wscancel := func() {}
+	if opts.Transport == TransportWebSocket {
+		var wsctx context.Context
+		wsctx, wscancel = context.WithCancel(detachedContext{ctx})
+		bind = newWebSocketBind(wsctx, endpointHost, opts.TLSConfig)
+	}
+
+	wgDev := device.NewDevice(tunDev, bind, deviceLogger(detachedContext{ctx}, cfg.LogLevel))
+
 	if err := wgDev.IpcSetOperation(bufio.NewReader(wgConf)); err != nil {
+		wgDev.Close()
+		wscancel()
 		return nil, err
 	}
 	err = wgDev.Up()
 	if err != nil {
+		wgDev.Close()
+		wscancel()
 		return nil, errors.New("tunnel error (wgDev.Up()): " + err.Error())
 	}
 
 	return &Tunnel{
-		dev:       wgDev,
-		tun:       tunDev,
-		net:       gNet,
-		dnsIP:     cfg.DNS,
-		Config:    cfg,
-		State:     state,
-		apiClient: apiClient,
+		dev:      wgDev,
+		tun:      tunDev,
+		net:      gNet,
+		dnsIP:    cfg.DNS,
+		Config:   &cfg,
+		options:  opts,
+		wscancel: wscancel,
+		logCtx:   detachedContext{ctx},
 
 		resolv: &net.Resolver{
 			PreferGo: true,
@@ -223,6 +305,58 @@ func doConnect(_ context.Context, state *WireGuardState, apiClient *rawgql.Clien
 	}, nil
 }
 
+// connectPeer opens a tunnel as the registered peer state.
+func connectPeer(ctx context.Context, state *WireGuardState, apiClient *rawgql.Client, opts Options) (*Tunnel, error) {
+	tunnel, err := connect(ctx, state.TunnelConfig(), opts)
+	if err != nil {
+		return nil, err
+	}
+	tunnel.State = state
+	tunnel.apiClient = apiClient
+	return tunnel, nil
+}
+
+// connect opens a tunnel with cfg over the transport opts asks for. With TransportAuto it tries udp first and falls
+// back to websockets when the gateway doesn't answer the handshake.
+func connect(ctx context.Context, cfg *Config, opts Options) (*Tunnel, error) {
+	if opts.Transport != TransportAuto {
+		return doConnect(ctx, cfg, opts)
+	}
+
+	udp := opts
+	udp.Transport = TransportUDP
+	tunnel, err := doConnect(ctx, cfg, udp)
+	if err == nil {
+		err = tunnel.waitForHandshake(ctx, handshakeTimeout)
+		if err == nil {
+			tunnel.options = opts
+			return tunnel, nil
+		}
+		tunnel.closeDevice()
+	}
+	tflog.Info(ctx, fmt.Sprintf("no wireguard handshake over udp, falling back to websockets: %s", err))
+
+	ws := opts
+	ws.Transport = TransportWebSocket
+	tunnel, err = doConnect(ctx, cfg, ws)
+	if err != nil {
+		return nil, err
+	}
+	tunnel.options = opts
+	return tunnel, nil
+}
+
+// closeDevice closes the wireguard device and stops its websocket, if it has one.
+func (t *Tunnel) closeDevice() {
+	if t.dev != nil {
+		t.dev.Close()
+	}
+	if t.wscancel != nil {
+		t.wscancel()
+	}
+	t.dev, t.tun, t.net = nil, nil, nil
+}
+
 func (t *Tunnel) Resolver() *net.Resolver {
 	return t.resolv
 }
@@ -256,7 +390,6 @@ type Transport struct {
 }
 
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	fmt.Println(req)
 	req.Header.Add("Authorization", "Bearer "+t.token)
 	return t.underlyingTransport.RoundTrip(req)
 }
@@ -275,21 +408,69 @@ func (t *Tunnel) NewHttpClient() Client {
 }
 
 func (t *Tunnel) NetStack() *netstack.Net {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	return t.net
 }
 
+// DialContext dials through the tunnel's current network stack. Unlike a dial function taken from NetStack it keeps
+// working after the supervisor rebuilds the tunnel.
+func (t *Tunnel) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	n := t.NetStack()
+	if n == nil {
+		return nil, errors.New("tunnel is down")
+	}
+	return n.DialContext(ctx, network, address)
+}
+
+// peerRemovalTimeout bounds removing the peer in Down, which runs as the provider process exits and is killed soon
+// after. A peer that isn't removed in time is left to CollectStalePeers.
+const peerRemovalTimeout = 1500 * time.Millisecond
+
+// Down closes the tunnel and removes its peer from the org, unless the peer is cached for reuse or came with a fixed
+// config. The tunnel is closed even if removing the peer fails, which is logged as a warning and returned.
 func (t *Tunnel) Down() error {
-	_, err := graphql.RemoveWireguardPeer(context.Background(), *t.apiClient, graphql.RemoveWireGuardPeerInput{
-		OrganizationId: t.State.Org,
-		Name:           t.State.Name,
+	if t.supervisor != nil {
+		t.supervisor()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.State == nil {
+		t.closeDevice()
+		return nil
+	}
+	if t.cached {
+		t.closeDevice()
+		t.claim.release()
+		t.claim = nil
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(utils.WithoutRetries(context.Background()), peerRemovalTimeout)
+	defer cancel()
+	err := t.dropPeer(ctx, t.State)
+	t.closeDevice()
+	if err != nil && t.logCtx != nil {
+		tflog.Warn(t.logCtx, fmt.Sprintf("wireguard peer %s was left behind, tunnel_gc_max_age removes it in a later run: %s", t.State.Name, err))
+	}
+	return err
+}
+
+// dropPeer removes the registered peer state, through whatever registered it.
+func (t *Tunnel) dropPeer(ctx context.Context, state *WireGuardState) error {
+	if t.delegated != nil {
+		return t.delegated.remove(ctx, state.Name)
+	}
+	return removePeer(ctx, t.apiClient, state.Org, state.Name)
+}
+
+func removePeer(ctx context.Context, client *rawgql.Client, org string, name string) error {
+	_, err := graphql.RemoveWireguardPeer(ctx, *client, graphql.RemoveWireGuardPeerInput{
+		OrganizationId: org,
+		Name:           name,
 	})
 	if err != nil {
-		// Silently ignore this error for now. It's not the end of the world if the peer isn't removed
+		return fmt.Errorf("removing wireguard peer %s: %w", name, err)
 	}
-	if t.dev != nil {
-		t.dev.Close()
-	}
-	t.dev, t.tun, t.net = nil, nil, nil
 	return nil
 }
 
@@ -343,8 +524,76 @@ func (t *Tunnel) QueryDNS(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	return r, err
 }
 
-func Establish(ctx context.Context, org string, region string, token string, client *rawgql.Client) (*Tunnel, error) {
-	peerName := "terraform-tunnel-" + strconv.FormatInt(time.Now().Unix(), 10) + uuid.New().String()
+// PeerPrefix starts the name of every peer Establish registers, the name goes on with the unix time the peer was
+// created at and a uuid.
+const PeerPrefix = "terraform-tunnel-"
+
+// peerCreatedAt returns when the peer named name was registered by Establish.
+func peerCreatedAt(name string) (time.Time, bool) {
+	const uuidLength = 36
+	if !strings.HasPrefix(name, PeerPrefix) || len(name) <= len(PeerPrefix)+uuidLength {
+		return time.Time{}, false
+	}
+	ts, err := strconv.ParseInt(name[len(PeerPrefix):len(name)-uuidLength], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(ts, 0), true
+}
+
+// CollectStalePeers removes the org's peers registered by Establish more than maxAge ago, which are left behind by
+// provider processes that didn't get to take their tunnel down. Peers named in keep, like the ones in a PeerCache,
+// are left alone. It returns the names of the removed peers, and the errors of the peers that couldn't be removed.
+func CollectStalePeers(ctx context.Context, org string, maxAge time.Duration, keep []string, client *rawgql.Client) ([]string, []error) {
+	var removed []string
+	var errs []error
+	after := ""
+	for {
+		res, err := graphql.WireguardPeers(ctx, *client, org, after)
+		if err != nil {
+			return removed, append(errs, fmt.Errorf("listing wireguard peers: %w", err))
+		}
+		peers := res.Organization.WireGuardPeers
+		for _, peer := range peers.Nodes {
+			createdAt, ok := peerCreatedAt(peer.Name)
+			if !ok || time.Since(createdAt) < maxAge || contains(keep, peer.Name) {
+				continue
+			}
+			err = removePeer(ctx, client, org, peer.Name)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			removed = append(removed, peer.Name)
+		}
+		if !peers.PageInfo.HasNextPage {
+			return removed, errs
+		}
+		after = peers.PageInfo.EndCursor
+	}
+}
+
+func Establish(ctx context.Context, org string, region string, token string, client *rawgql.Client, opts Options) (*Tunnel, error) {
+	state, err := registerPeer(ctx, org, region, token, client)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel, err := connectPeer(ctx, state, client, opts)
+	if err != nil {
+		return nil, errors.New("tunnel error (doConnect): " + err.Error())
+	}
+	return tunnel, nil
+}
+
+// newPeerName returns a name for a peer registered now.
+func newPeerName() string {
+	return PeerPrefix + strconv.FormatInt(time.Now().Unix(), 10) + uuid.New().String()
+}
+
+// registerPeer adds a new peer to the org, with a fresh key pair.
+func registerPeer(ctx context.Context, org string, region string, token string, client *rawgql.Client) (*WireGuardState, error) {
+	peerName := newPeerName()
 	public, private := C25519pair()
 
 	peer, err := graphql.AddWireguardPeer(ctx, *client, graphql.AddWireGuardPeerInput{
@@ -367,10 +616,14 @@ func Establish(ctx context.Context, org string, region string, token string, cli
 		Peer:         peer.AddWireGuardPeer,
 		Token:        token,
 	}
+	return &state, nil
+}
 
-	tunnel, err := doConnect(ctx, &state, client)
-	if err != nil {
-		return nil, errors.New("tunnel error (doConnect): " + err.Error())
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
-	return tunnel, nil
+	return false
 }
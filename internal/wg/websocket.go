@@ -0,0 +1,194 @@
+package wg
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+const (
+	TransportUDP       = "udp"
+	TransportWebSocket = "websocket"
+	// TransportAuto tries udp first and falls back to websockets when there is no handshake.
+	TransportAuto = "auto"
+)
+
+// websocketPort is where the gateways accept wireguard carried over websockets, for networks that block udp.
+const websocketPort = "443"
+
+// webSocketBind is a conn.Bind that carries wireguard packets as binary websocket messages to a single gateway,
+// instead of udp datagrams. A dropped websocket is redialed when the next packet is read.
+type webSocketBind struct {
+	url       string
+	ctx       context.Context
+	tlsConfig *tls.Config
+
+	mu       sync.Mutex
+	ws       *websocket.Conn
+	closed   bool
+	endpoint webSocketEndpoint
+}
+
+type webSocketEndpoint struct {
+	dst netip.AddrPort
+}
+
+var _ conn.Bind = &webSocketBind{}
+var _ conn.Endpoint = webSocketEndpoint{}
+
+// newWebSocketBind returns a bind to the gateway at host, verified with tlsConfig when it is set. ctx ends redials,
+// the bind is closed by the device.
+func newWebSocketBind(ctx context.Context, host string, tlsConfig *tls.Config) *webSocketBind {
+	return &webSocketBind{
+		url:       fmt.Sprintf("wss://%s/", net.JoinHostPort(host, websocketPort)),
+		ctx:       ctx,
+		tlsConfig: tlsConfig,
+	}
+}
+
+func (b *webSocketBind) dial() (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(b.url, "https://"+net.JoinHostPort("localhost", websocketPort))
+	if err != nil {
+		return nil, err
+	}
+	config.Dialer = &net.Dialer{Timeout: 10 * time.Second}
+	if b.tlsConfig != nil {
+		config.TlsConfig = b.tlsConfig.Clone()
+	}
+	return websocket.DialConfig(config)
+}
+
+// conn returns the open websocket, dialing a new one if there is none. The dial happens outside the lock so a slow
+// gateway doesn't hold up the other users of the bind.
+func (b *webSocketBind) conn() (*websocket.Conn, error) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	if b.ws != nil {
+		ws := b.ws
+		b.mu.Unlock()
+		return ws, nil
+	}
+	b.mu.Unlock()
+
+	ws, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		ws.Close()
+		return nil, net.ErrClosed
+	}
+	if b.ws != nil {
+		// Dialed concurrently, keep the one already in use.
+		ws.Close()
+		return b.ws, nil
+	}
+	b.ws = ws
+	return ws, nil
+}
+
+// drop forgets ws after it failed, so the next use dials again.
+func (b *webSocketBind) drop(ws *websocket.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ws == ws {
+		b.ws.Close()
+		b.ws = nil
+	}
+}
+
+func (b *webSocketBind) Open(_ uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	b.closed = false
+	b.mu.Unlock()
+	return []conn.ReceiveFunc{b.receive}, 0, nil
+}
+
+func (b *webSocketBind) receive(packet []byte) (int, conn.Endpoint, error) {
+	for {
+		ws, err := b.conn()
+		if errors.Is(err, net.ErrClosed) {
+			return 0, nil, err
+		}
+		if err != nil {
+			select {
+			case <-b.ctx.Done():
+				return 0, nil, net.ErrClosed
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+
+		var msg []byte
+		err = websocket.Message.Receive(ws, &msg)
+		if err != nil {
+			b.drop(ws)
+			continue
+		}
+		b.mu.Lock()
+		endpoint := b.endpoint
+		b.mu.Unlock()
+		return copy(packet, msg), endpoint, nil
+	}
+}
+
+func (b *webSocketBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	if b.ws != nil {
+		err := b.ws.Close()
+		b.ws = nil
+		return err
+	}
+	return nil
+}
+
+func (b *webSocketBind) SetMark(_ uint32) error {
+	return nil
+}
+
+func (b *webSocketBind) Send(packet []byte, _ conn.Endpoint) error {
+	ws, err := b.conn()
+	if err != nil {
+		return err
+	}
+	err = websocket.Message.Send(ws, packet)
+	if err != nil {
+		b.drop(ws)
+	}
+	return err
+}
+
+func (b *webSocketBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	dst, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := webSocketEndpoint{dst: dst}
+	b.mu.Lock()
+	b.endpoint = endpoint
+	b.mu.Unlock()
+	return endpoint, nil
+}
+
+func (e webSocketEndpoint) ClearSrc()           {}
+func (e webSocketEndpoint) SrcToString() string { return "" }
+func (e webSocketEndpoint) DstToString() string { return e.dst.String() }
+func (e webSocketEndpoint) DstToBytes() []byte  { b, _ := e.dst.MarshalBinary(); return b }
+func (e webSocketEndpoint) DstIP() netip.Addr   { return e.dst.Addr() }
+func (e webSocketEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
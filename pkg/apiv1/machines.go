@@ -1,16 +1,80 @@
 package apiv1
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/Khan/genqlient/graphql"
+	"github.com/fly-apps/terraform-provider-fly/internal/utils"
 	hreq "github.com/imroc/req/v3"
 	"net/http"
+	"strings"
 	"time"
 )
 
 var NonceHeader = "fly-machine-lease-nonce"
 
+// IdempotencyKeyMetadata is the metadata key CreateMachineIdempotent tags new machines with.
+var IdempotencyKeyMetadata = "terraform_idempotency_key"
+
+// RequestError is returned when the machines api answers with an unexpected status code.
+type RequestError struct {
+	Op         string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s request failed: %s, %s", e.Op, e.Status, e.Body)
+}
+
+// Retryable reports whether err may be resolved by sending the same request again:
+// transport errors and server side failures are, rejected requests, capacity errors and cancellations are not.
+func Retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode >= http.StatusInternalServerError && !IsCapacityError(err)
+	}
+	return err != nil
+}
+
+// capacityErrors are the messages the api gives when no host in a region can take a machine. Other failures share
+// their status codes, lease conflicts and failed preconditions also return 412, so only the message tells them apart.
+var capacityErrors = []string{
+	"insufficient resources",
+	"insufficient memory",
+	"insufficient cpus",
+	"could not reserve resource",
+	"no capacity available",
+}
+
+// IsCapacityError reports whether err is the api refusing to place a machine because its region is out of capacity.
+func IsCapacityError(err error) bool {
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) {
+		return false
+	}
+	message := reqErr.Body
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal([]byte(reqErr.Body), &body) == nil && body.Error != "" {
+		message = body.Error
+	}
+	message = strings.ToLower(message)
+	for _, e := range capacityErrors {
+		if strings.Contains(message, e) {
+			return true
+		}
+	}
+	return false
+}
+
 type MachineAPI struct {
 	client     *graphql.Client
 	httpClient *hreq.Client
@@ -39,27 +103,95 @@ type InitConfig struct {
 	Cmd        []string `json:"cmd,omitempty"`
 	Entrypoint []string `json:"entrypoint,omitempty"`
 	Exec       []string `json:"exec,omitempty"`
+	Tty        bool     `json:"tty,omitempty"`
+	SwapSizeMb int      `json:"swap_size_mb,omitempty"`
+	KernelArgs []string `json:"kernel_args,omitempty"`
+}
+
+type DNSConfig struct {
+	SkipRegistration bool     `json:"skip_registration,omitempty"`
+	Nameservers      []string `json:"nameservers,omitempty"`
 }
 
 type MachineConfig struct {
-	Image    string            `json:"image"`
+	Image    string            `json:"image,omitempty"`
 	Env      map[string]string `json:"env"`
 	Init     InitConfig        `json:"init,omitempty"`
 	Mounts   []MachineMount    `json:"mounts,omitempty"`
 	Services []Service         `json:"services"`
 	Guest    GuestConfig       `json:"guest,omitempty"`
+	Standbys []string          `json:"standbys,omitempty"`
+	DNS      *DNSConfig        `json:"dns,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	Containers []ContainerConfig `json:"containers,omitempty"`
+}
+
+// ContainerConfig is one of the containers of a multi-container machine, which runs them in place of the
+// top-level image.
+type ContainerConfig struct {
+	Name         string                 `json:"name"`
+	Image        string                 `json:"image"`
+	Cmd          []string               `json:"cmd,omitempty"`
+	Entrypoint   []string               `json:"entrypoint,omitempty"`
+	Env          map[string]string      `json:"env,omitempty"`
+	Files        []ContainerFile        `json:"files,omitempty"`
+	Healthchecks []ContainerHealthcheck `json:"healthchecks,omitempty"`
+	DependsOn    []ContainerDependency  `json:"depends_on,omitempty"`
+}
+
+type ContainerFile struct {
+	GuestPath  string `json:"guest_path"`
+	RawValue   string `json:"raw_value,omitempty"`
+	SecretName string `json:"secret_name,omitempty"`
+}
+
+type ContainerHealthcheck struct {
+	Name             string                    `json:"name,omitempty"`
+	Exec             *ContainerExecHealthcheck `json:"exec,omitempty"`
+	HTTP             *ContainerHTTPHealthcheck `json:"http,omitempty"`
+	TCP              *ContainerTCPHealthcheck  `json:"tcp,omitempty"`
+	Interval         int                       `json:"interval,omitempty"`
+	Timeout          int                       `json:"timeout,omitempty"`
+	FailureThreshold int                       `json:"failure_threshold,omitempty"`
+}
+
+type ContainerExecHealthcheck struct {
+	Command []string `json:"command"`
+}
+
+type ContainerHTTPHealthcheck struct {
+	Port int    `json:"port"`
+	Path string `json:"path,omitempty"`
+}
+
+type ContainerTCPHealthcheck struct {
+	Port int `json:"port"`
+}
+
+type ContainerDependency struct {
+	Name      string `json:"name"`
+	Condition string `json:"condition,omitempty"`
 }
 
 type GuestConfig struct {
-	Cpus     int    `json:"cpus,omitempty"`
-	MemoryMb int    `json:"memory_mb,omitempty"`
-	CpuType  string `json:"cpu_kind,omitempty"`
+	Cpus             int    `json:"cpus,omitempty"`
+	MemoryMb         int    `json:"memory_mb,omitempty"`
+	CpuType          string `json:"cpu_kind,omitempty"`
+	HostDedicationID string `json:"host_dedication_id,omitempty"`
+}
+
+// PlacementConfig holds scheduling hints that only matter while a machine is being placed.
+type PlacementConfig struct {
+	PreferZone string `json:"prefer_zone,omitempty"`
+	AvoidZone  string `json:"avoid_zone,omitempty"`
 }
 
 type MachineCreateOrUpdateRequest struct {
-	Name   string        `json:"name"`
-	Region string        `json:"region"`
-	Config MachineConfig `json:"config"`
+	Name      string           `json:"name"`
+	Region    string           `json:"region"`
+	Config    MachineConfig    `json:"config"`
+	Placement *PlacementConfig `json:"placement,omitempty"`
 }
 
 type MachineResponse struct {
@@ -75,20 +207,26 @@ type MachineResponse struct {
 			Exec       []string `json:"exec"`
 			Entrypoint []string `json:"entrypoint"`
 			Cmd        []string `json:"cmd"`
-			//Tty        bool        `json:"tty"`
+			Tty        bool     `json:"tty"`
+			SwapSizeMb int      `json:"swap_size_mb"`
+			KernelArgs []string `json:"kernel_args"`
 		} `json:"init"`
-		Image    string      `json:"image"`
-		Metadata interface{} `json:"metadata"`
+		Image    string            `json:"image"`
+		Metadata map[string]string `json:"metadata"`
 		Restart  struct {
 			Policy string `json:"policy"`
 		} `json:"restart"`
 		Services []Service      `json:"services"`
 		Mounts   []MachineMount `json:"mounts"`
 		Guest    struct {
-			CPUKind  string `json:"cpu_kind"`
-			Cpus     int    `json:"cpus"`
-			MemoryMb int    `json:"memory_mb"`
+			CPUKind          string `json:"cpu_kind"`
+			Cpus             int    `json:"cpus"`
+			MemoryMb         int    `json:"memory_mb"`
+			HostDedicationID string `json:"host_dedication_id"`
 		} `json:"guest"`
+		Standbys   []string          `json:"standbys"`
+		DNS        *DNSConfig        `json:"dns"`
+		Containers []ContainerConfig `json:"containers"`
 	} `json:"config"`
 	ImageRef struct {
 		Registry   string `json:"registry"`
@@ -98,7 +236,64 @@ type MachineResponse struct {
 		Labels     struct {
 		} `json:"labels"`
 	} `json:"image_ref"`
-	CreatedAt time.Time `json:"created_at"`
+	Events    []MachineEvent       `json:"events"`
+	Checks    []MachineCheckStatus `json:"checks"`
+	CreatedAt time.Time            `json:"created_at"`
+}
+
+type MachineCheckStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Output string `json:"output"`
+}
+
+// MachineVersion is an entry in a machine's config history. Version is the instance ID the config was applied as.
+type MachineVersion struct {
+	Version    string        `json:"version"`
+	UserConfig MachineConfig `json:"user_config"`
+}
+
+type Volume struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	State             string `json:"state"`
+	Region            string `json:"region"`
+	SizeGb            int    `json:"size_gb"`
+	Encrypted         bool   `json:"encrypted"`
+	AttachedMachineID string `json:"attached_machine_id"`
+}
+
+type MachineEvent struct {
+	ID        string               `json:"id"`
+	Type      string               `json:"type"`
+	Status    string               `json:"status"`
+	Source    string               `json:"source"`
+	Timestamp int64                `json:"timestamp"`
+	Request   *MachineEventRequest `json:"request,omitempty"`
+}
+
+type MachineEventRequest struct {
+	ExitEvent *MachineExitEvent `json:"exit_event,omitempty"`
+}
+
+type MachineExitEvent struct {
+	ExitCode      int    `json:"exit_code"`
+	OOMKilled     bool   `json:"oom_killed"`
+	RequestedStop bool   `json:"requested_stop"`
+	ExitedAt      string `json:"exited_at"`
+}
+
+// Time returns the time the event was recorded; the API reports timestamps in milliseconds since the epoch.
+func (e MachineEvent) Time() time.Time {
+	return time.UnixMilli(e.Timestamp)
+}
+
+// ExitCode returns the exit code carried by an exit event, and false for events that have none.
+func (e MachineEvent) ExitCode() (int, bool) {
+	if e.Request == nil || e.Request.ExitEvent == nil {
+		return 0, false
+	}
+	return e.Request.ExitEvent.ExitCode, true
 }
 
 type MachineLease struct {
@@ -110,16 +305,28 @@ type MachineLease struct {
 	}
 }
 
+// PublicEndpoint is the machines api as served over the internet, reachable without a tunnel.
+const PublicEndpoint = "https://api.machines.dev"
+
+// EndpointURL returns endpoint as a base url. A bare host:port, like `fly proxy` and the tunnel serve the api on, is
+// plain http.
+func EndpointURL(endpoint string) string {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	return strings.TrimSuffix(endpoint, "/")
+}
+
 func NewMachineAPI(httpClient *hreq.Client, endpoint string) *MachineAPI {
 	return &MachineAPI{
 		httpClient: httpClient,
-		endpoint:   endpoint,
+		endpoint:   EndpointURL(endpoint),
 	}
 }
 
 func (a *MachineAPI) LockMachine(app string, id string, timeout int) (*MachineLease, error) {
 	var res MachineLease
-	_, err := a.httpClient.R().SetResult(&res).Post(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s/lease/?ttl=%d", a.endpoint, app, id, timeout))
+	_, err := a.httpClient.R().SetResult(&res).Post(fmt.Sprintf("%s/v1/apps/%s/machines/%s/lease/?ttl=%d", a.endpoint, app, id, timeout))
 	if err != nil {
 		return nil, err
 	}
@@ -127,7 +334,7 @@ func (a *MachineAPI) LockMachine(app string, id string, timeout int) (*MachineLe
 }
 
 func (a *MachineAPI) ReleaseMachine(lease MachineLease, app string, id string) error {
-	_, err := a.httpClient.R().SetHeader(NonceHeader, lease.Data.Nonce).Delete(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s/lease", a.endpoint, app, id))
+	_, err := a.httpClient.R().SetHeader(NonceHeader, lease.Data.Nonce).Delete(fmt.Sprintf("%s/v1/apps/%s/machines/%s/lease", a.endpoint, app, id))
 	if err != nil {
 		return err
 	}
@@ -135,50 +342,77 @@ func (a *MachineAPI) ReleaseMachine(lease MachineLease, app string, id string) e
 }
 
 func (a *MachineAPI) WaitForMachine(app string, id string, instanceID string) error {
-	_, err := a.httpClient.R().Get(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s/wait?instance_id=%s", a.endpoint, app, id, instanceID))
-	return err
+	return a.WaitForMachineState(app, id, instanceID, "started")
 }
 
-// CreateMachine takes a MachineCreateOrUpdateRequest and creates the requested machine in the given app and then writes the response into the `res` param
-func (a *MachineAPI) CreateMachine(req MachineCreateOrUpdateRequest, app string, res *MachineResponse) error {
-	if req.Config.Guest.CpuType == "" {
-		req.Config.Guest.CpuType = "shared"
-	}
-	if req.Config.Guest.Cpus == 0 {
-		req.Config.Guest.Cpus = 1
+// WaitForMachineState blocks until the given instance of the machine reaches state, or the api gives up waiting.
+func (a *MachineAPI) WaitForMachineState(app string, id string, instanceID string, state string) error {
+	waitResponse, err := a.httpClient.R().Get(fmt.Sprintf("%s/v1/apps/%s/machines/%s/wait?instance_id=%s&state=%s", a.endpoint, app, id, instanceID, state))
+	if err != nil {
+		return err
 	}
-	if req.Config.Guest.MemoryMb == 0 {
-		req.Config.Guest.MemoryMb = 256
+	if waitResponse.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Wait request failed: %s", waitResponse.Status))
 	}
-	createResponse, err := a.httpClient.R().SetBody(req).SetResult(res).Post(fmt.Sprintf("http://%s/v1/apps/%s/machines", a.endpoint, app))
+	return nil
+}
+
+// CreateMachine takes a MachineCreateOrUpdateRequest and creates the requested machine in the given app and then writes the response into the `res` param
+func (a *MachineAPI) CreateMachine(req MachineCreateOrUpdateRequest, app string, res *MachineResponse) error {
+	createResponse, err := a.httpClient.R().SetBody(req).SetResult(res).Post(fmt.Sprintf("%s/v1/apps/%s/machines", a.endpoint, app))
 
 	if err != nil {
 		return err
 	}
 
 	if createResponse.StatusCode != http.StatusCreated && createResponse.StatusCode != http.StatusOK {
-		return errors.New(fmt.Sprintf("Create request failed: %s, %+v", createResponse.Status, createResponse))
+		return &RequestError{Op: "Create", StatusCode: createResponse.StatusCode, Status: createResponse.Status, Body: createResponse.String()}
 	}
 	return nil
 }
 
-func (a *MachineAPI) UpdateMachine(req MachineCreateOrUpdateRequest, app string, id string, res *MachineResponse) error {
-	if req.Config.Guest.CpuType == "" {
-		req.Config.Guest.CpuType = "shared"
-	}
-	if req.Config.Guest.Cpus == 0 {
-		//You can't have a machine with no cpus
-		req.Config.Guest.Cpus = 1
+// CreateMachineIdempotent tags the machine with key in its metadata and creates it, retrying up to attempts times.
+// After every failed attempt it looks for a machine already carrying the key, so a create that succeeded on the
+// api side but failed on ours (e.g. a client timeout) is adopted instead of duplicated. Retrying stops when ctx is done.
+func (a *MachineAPI) CreateMachineIdempotent(ctx context.Context, req MachineCreateOrUpdateRequest, app string, key string, attempts int, res *MachineResponse) error {
+	metadata := map[string]string{}
+	for k, v := range req.Config.Metadata {
+		metadata[k] = v
 	}
-	if req.Config.Guest.MemoryMb == 0 {
-		//You can't have a machine with no memory
-		req.Config.Guest.MemoryMb = 256
+	metadata[IdempotencyKeyMetadata] = key
+	req.Config.Metadata = metadata
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(utils.RetryBackoff(i, utils.DefaultRetryMaxWait)):
+			}
+		}
+		err = a.CreateMachine(req, app, res)
+		if err == nil {
+			return nil
+		}
+		existing, findErr := a.FindMachineByMetadata(app, IdempotencyKeyMetadata, key)
+		if findErr == nil && existing != nil {
+			*res = *existing
+			return nil
+		}
+		if !Retryable(err) {
+			return err
+		}
 	}
+	return err
+}
+
+func (a *MachineAPI) UpdateMachine(req MachineCreateOrUpdateRequest, app string, id string, res *MachineResponse) error {
 	lease, err := a.LockMachine(app, id, 30)
 	if err != nil {
 		return err
 	}
-	reqRes, err := a.httpClient.R().SetBody(req).SetResult(res).SetHeader(NonceHeader, lease.Data.Nonce).Post(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s", a.endpoint, app, id))
+	reqRes, err := a.httpClient.R().SetBody(req).SetResult(res).SetHeader(NonceHeader, lease.Data.Nonce).Post(fmt.Sprintf("%s/v1/apps/%s/machines/%s", a.endpoint, app, id))
 	if err != nil {
 		return err
 	}
@@ -193,39 +427,166 @@ func (a *MachineAPI) UpdateMachine(req MachineCreateOrUpdateRequest, app string,
 }
 
 func (a *MachineAPI) ReadMachine(app string, id string, res *MachineResponse) (*hreq.Response, error) {
-	return a.httpClient.R().SetResult(res).Get(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s", a.endpoint, app, id))
+	return a.httpClient.R().SetResult(res).Get(fmt.Sprintf("%s/v1/apps/%s/machines/%s", a.endpoint, app, id))
 }
 
-func (a *MachineAPI) DeleteMachine(app string, id string, maxRetries int) error {
-	deleted := false
-	for i := 0; i < maxRetries; i++ {
-		var machine MachineResponse
-		readResponse, err := a.httpClient.R().SetResult(&machine).Get(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s", a.endpoint, app, id))
-		if err != nil {
-			return err
+func (a *MachineAPI) StopMachine(ctx context.Context, app string, id string) error {
+	stopResponse, err := a.httpClient.R().SetContext(ctx).Post(fmt.Sprintf("%s/v1/apps/%s/machines/%s/stop", a.endpoint, app, id))
+	if err != nil {
+		return err
+	}
+	if stopResponse.StatusCode != http.StatusOK {
+		return &RequestError{Op: "Stop", StatusCode: stopResponse.StatusCode, Status: stopResponse.Status, Body: stopResponse.String()}
+	}
+	return nil
+}
+
+// ListMachineVersions returns the machine's config history, newest first.
+func (a *MachineAPI) ListMachineVersions(app string, id string) ([]MachineVersion, error) {
+	var versions []MachineVersion
+	listResponse, err := a.httpClient.R().SetResult(&versions).Get(fmt.Sprintf("%s/v1/apps/%s/machines/%s/versions", a.endpoint, app, id))
+	if err != nil {
+		return nil, err
+	}
+	if listResponse.StatusCode != http.StatusOK {
+		return nil, &RequestError{Op: "Versions", StatusCode: listResponse.StatusCode, Status: listResponse.Status, Body: listResponse.String()}
+	}
+	return versions, nil
+}
+
+func (a *MachineAPI) ListMachines(app string) ([]MachineResponse, error) {
+	var machines []MachineResponse
+	listResponse, err := a.httpClient.R().SetResult(&machines).Get(fmt.Sprintf("%s/v1/apps/%s/machines", a.endpoint, app))
+	if err != nil {
+		return nil, err
+	}
+	if listResponse.StatusCode != http.StatusOK {
+		return nil, &RequestError{Op: "List", StatusCode: listResponse.StatusCode, Status: listResponse.Status, Body: listResponse.String()}
+	}
+	return machines, nil
+}
+
+func (a *MachineAPI) ListVolumes(app string) ([]Volume, error) {
+	var volumes []Volume
+	listResponse, err := a.httpClient.R().SetResult(&volumes).Get(fmt.Sprintf("%s/v1/apps/%s/volumes", a.endpoint, app))
+	if err != nil {
+		return nil, err
+	}
+	if listResponse.StatusCode != http.StatusOK {
+		return nil, &RequestError{Op: "List volumes", StatusCode: listResponse.StatusCode, Status: listResponse.Status, Body: listResponse.String()}
+	}
+	return volumes, nil
+}
+
+// FindMachineByMetadata returns the app's machine whose metadata has key set to value, or nil if there is none.
+func (a *MachineAPI) FindMachineByMetadata(app string, key string, value string) (*MachineResponse, error) {
+	machines, err := a.ListMachines(app)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range machines {
+		if m.Config.Metadata[key] == value {
+			return &m, nil
 		}
+	}
+	return nil, nil
+}
 
-		if readResponse.StatusCode == 200 {
-			if machine.State == "started" || machine.State == "starting" || machine.State == "replacing" {
-				_, _ = a.httpClient.R().Post(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s/stop", a.endpoint, app, id))
-			}
-			if machine.State == "stopping" || machine.State == "destroying" {
-				time.Sleep(5 * time.Second)
-			}
-			if machine.State == "stopped" || machine.State == "replaced" {
-				_, err = a.httpClient.R().Delete(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s", a.endpoint, app, id))
-				if err != nil {
-					return err
+// deleteTimeout bounds DeleteMachine when the caller's context has no earlier deadline.
+const deleteTimeout = 5 * time.Minute
+
+// DeleteMachine stops and destroys the machine, polling with exponential backoff until it is gone. With force set
+// a running machine is killed instead of stopped and the delete is forced, so a machine stuck stopping doesn't
+// block it. The error reports the last state the machine was seen in.
+func (a *MachineAPI) DeleteMachine(ctx context.Context, app string, id string, force bool) error {
+	ctx, cancel := context.WithTimeout(ctx, deleteTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/v1/apps/%s/machines/%s", a.endpoint, app, id)
+	state := "unknown"
+	var lastErr error
+	delay := time.Second
+	for {
+		var machine MachineResponse
+		readResponse, err := a.httpClient.R().SetContext(ctx).SetResult(&machine).Get(url)
+		switch {
+		case err != nil:
+			lastErr = err
+		case readResponse.StatusCode == http.StatusNotFound:
+			return nil
+		case readResponse.StatusCode != http.StatusOK:
+			lastErr = &RequestError{Op: "Read", StatusCode: readResponse.StatusCode, Status: readResponse.Status, Body: readResponse.String()}
+		default:
+			state = machine.State
+			switch {
+			case state == "destroyed":
+				return nil
+			case state == "destroying":
+				// Wait for it.
+			case force:
+				// A failed kill is reported along with the destroy, which is still tried since it can succeed anyway.
+				var killErr error
+				if machineRunning(state) {
+					if err := a.signalMachine(ctx, app, id, "SIGKILL"); err != nil {
+						killErr = fmt.Errorf("killing machine: %w", err)
+					}
 				}
+				lastErr = errors.Join(killErr, a.destroyMachine(ctx, url, true))
+			case state == "started" || state == "starting" || state == "replacing":
+				lastErr = a.StopMachine(ctx, app, id)
+			case !machineRunning(state):
+				lastErr = a.destroyMachine(ctx, url, false)
 			}
-			if machine.State == "destroyed" {
-				deleted = true
-				break
+		}
+
+		select {
+		case <-ctx.Done():
+			if lastErr == nil {
+				lastErr = ctx.Err()
 			}
+			return fmt.Errorf("machine %s was not destroyed, last observed state %s: %w", id, state, lastErr)
+		case <-time.After(delay):
 		}
+		delay *= 2
+		if delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+}
+
+// machineRunning reports whether a machine in state has a running or transitioning vm, which has to stop before the
+// machine can be destroyed without force. Any other state, like stopped, created, failed or suspended, can be
+// destroyed right away.
+func machineRunning(state string) bool {
+	switch state {
+	case "started", "starting", "replacing", "stopping", "suspending", "restarting":
+		return true
+	}
+	return false
+}
+
+func (a *MachineAPI) signalMachine(ctx context.Context, app string, id string, signal string) error {
+	signalResponse, err := a.httpClient.R().SetContext(ctx).SetBody(map[string]string{"signal": signal}).Post(fmt.Sprintf("%s/v1/apps/%s/machines/%s/signal", a.endpoint, app, id))
+	if err != nil {
+		return err
+	}
+	if signalResponse.StatusCode != http.StatusOK {
+		return &RequestError{Op: "Signal", StatusCode: signalResponse.StatusCode, Status: signalResponse.Status, Body: signalResponse.String()}
+	}
+	return nil
+}
+
+func (a *MachineAPI) destroyMachine(ctx context.Context, url string, force bool) error {
+	r := a.httpClient.R().SetContext(ctx)
+	if force {
+		r.SetQueryParam("force", "true")
+	}
+	deleteResponse, err := r.Delete(url)
+	if err != nil {
+		return err
 	}
-	if !deleted {
-		return errors.New("max retries exceeded")
+	if deleteResponse.StatusCode != http.StatusOK && deleteResponse.StatusCode != http.StatusNotFound {
+		return &RequestError{Op: "Delete", StatusCode: deleteResponse.StatusCode, Status: deleteResponse.Status, Body: deleteResponse.String()}
 	}
 	return nil
 }
@@ -0,0 +1,145 @@
+package apiv1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	hreq "github.com/imroc/req/v3"
+)
+
+// fakeMachine serves one machine the way the machines api does for DeleteMachine, recording the calls it gets.
+type fakeMachine struct {
+	mu    sync.Mutex
+	state string
+	calls []string
+	// broken makes signals and deletes fail.
+	broken bool
+}
+
+func (f *fakeMachine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	call := r.Method + " " + strings.TrimPrefix(r.URL.Path, "/v1/apps/app/machines/m1")
+	if r.URL.Query().Get("force") == "true" {
+		call += "?force"
+	}
+	f.calls = append(f.calls, call)
+
+	if f.state == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch {
+	case f.broken && r.Method != http.MethodGet:
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	case r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"id": "m1", "state": f.state})
+		return
+	case strings.HasSuffix(r.URL.Path, "/stop"):
+		f.state = "stopped"
+	case strings.HasSuffix(r.URL.Path, "/signal"):
+	case r.Method == http.MethodDelete:
+		if machineRunning(f.state) && r.URL.Query().Get("force") != "true" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		f.state = ""
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestDeleteMachine(t *testing.T) {
+	tests := []struct {
+		state string
+		force bool
+		want  []string
+	}{
+		{"created", false, []string{"GET ", "DELETE ", "GET "}},
+		{"failed", false, []string{"GET ", "DELETE ", "GET "}},
+		{"suspended", false, []string{"GET ", "DELETE ", "GET "}},
+		{"stopped", false, []string{"GET ", "DELETE ", "GET "}},
+		{"started", false, []string{"GET ", "POST /stop", "GET ", "DELETE ", "GET "}},
+		{"started", true, []string{"GET ", "POST /signal", "DELETE ?force", "GET "}},
+		{"stopping", true, []string{"GET ", "POST /signal", "DELETE ?force", "GET "}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		name := tt.state
+		if tt.force {
+			name += " forced"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			fake := &fakeMachine{state: tt.state}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			api := NewMachineAPI(hreq.C(), server.URL)
+			if err := api.DeleteMachine(context.Background(), "app", "m1", tt.force); err != nil {
+				t.Fatal(err)
+			}
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+			if strings.Join(fake.calls, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("got calls %q, want %q", fake.calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeleteMachineGone(t *testing.T) {
+	server := httptest.NewServer(&fakeMachine{})
+	defer server.Close()
+	api := NewMachineAPI(hreq.C(), server.URL)
+	if err := api.DeleteMachine(context.Background(), "app", "m1", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteMachineReportsFailedKill(t *testing.T) {
+	server := httptest.NewServer(&fakeMachine{state: "started", broken: true})
+	defer server.Close()
+	api := NewMachineAPI(hreq.C(), server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err := api.DeleteMachine(ctx, "app", "m1", true)
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	if !strings.Contains(err.Error(), "killing machine") || !strings.Contains(err.Error(), "Delete") {
+		t.Errorf("got %q, want both the kill and the destroy error", err)
+	}
+}
+
+func TestIsCapacityError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"insufficient resources", &RequestError{StatusCode: 412, Body: `{"error":"insufficient resources available to fulfill request: could not reserve resource for machine: insufficient memory available to fulfill request"}`}, true},
+		{"no capacity", &RequestError{StatusCode: 503, Body: `{"error":"no capacity available in ord"}`}, true},
+		{"plain body", &RequestError{StatusCode: 412, Body: "insufficient CPUs available to fulfill request"}, true},
+		{"lease conflict", &RequestError{StatusCode: 412, Body: `{"error":"machine ID m1 lease currently held by someone else"}`}, false},
+		{"failed precondition", &RequestError{StatusCode: 412, Body: `{"error":"min_secrets_version 3 is not yet available"}`}, false},
+		{"server error", &RequestError{StatusCode: 500, Body: `{"error":"internal error"}`}, false},
+		{"transport error", errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsCapacityError(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}